@@ -0,0 +1,143 @@
+package gosasl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// AuthorizationRules is an Authorizer granting principals the right to act as other
+// identities. Each rule maps a pattern of authenticated principals, e.g. "hive/*@EXAMPLE.COM",
+// to the patterns of the authorization ids they may use. Anything not allowed by a rule is
+// denied.
+//
+// Patterns are globs where '*' matches any sequence of characters but '/' and '@', '?' a
+// single one of them, and a lone "*" matches anything. Patterns enclosed in slashes, e.g.
+// "/^svc-[a-z]+$/", are regular expressions instead.
+type AuthorizationRules struct {
+	rules []authorizationRule
+}
+
+type authorizationRule struct {
+	principal        *regexp.Regexp
+	authorizationIDs []*regexp.Regexp
+}
+
+// NewAuthorizationRules returns an empty AuthorizationRules, denying everything
+func NewAuthorizationRules() *AuthorizationRules {
+	return &AuthorizationRules{}
+}
+
+// Allow adds a rule allowing the principals matching principal to act as the authorization
+// ids matching any of authorizationIDs
+func (r *AuthorizationRules) Allow(principal string, authorizationIDs ...string) error {
+	if len(authorizationIDs) == 0 {
+		return newError("", ErrInvalidOption, "the rule for %s allows no authorization id", principal)
+	}
+	rule := authorizationRule{}
+	var err error
+	if rule.principal, err = compileAuthorizationPattern(principal); err != nil {
+		return err
+	}
+	for _, authorizationID := range authorizationIDs {
+		pattern, err := compileAuthorizationPattern(authorizationID)
+		if err != nil {
+			return err
+		}
+		rule.authorizationIDs = append(rule.authorizationIDs, pattern)
+	}
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Authorize returns an error unless a rule allows authenticationID to act as authorizationID.
+// A nil AuthorizationRules denies everything, like an empty one.
+func (r *AuthorizationRules) Authorize(authenticationID string, authorizationID string) error {
+	if r == nil {
+		return fmt.Errorf("no rule allows %s to act as %s", authenticationID, authorizationID)
+	}
+	for _, rule := range r.rules {
+		if !rule.principal.MatchString(authenticationID) {
+			continue
+		}
+		for _, pattern := range rule.authorizationIDs {
+			if pattern.MatchString(authorizationID) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no rule allows %s to act as %s", authenticationID, authorizationID)
+}
+
+// compileAuthorizationPattern turns a glob or a regular expression enclosed in slashes into
+// an anchored regular expression
+func compileAuthorizationPattern(pattern string) (*regexp.Regexp, error) {
+	var expression string
+	switch {
+	case len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		expression = "^(?:" + pattern[1:len(pattern)-1] + ")$"
+	case pattern == "*":
+		expression = "^.*$"
+	case pattern == "":
+		return nil, newError("", ErrInvalidOption, "empty authorization pattern")
+	default:
+		var glob strings.Builder
+		for _, char := range pattern {
+			switch char {
+			case '*':
+				glob.WriteString("[^/@]*")
+			case '?':
+				glob.WriteString("[^/@]")
+			default:
+				glob.WriteString(regexp.QuoteMeta(string(char)))
+			}
+		}
+		expression = "^" + glob.String() + "$"
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, &Error{Kind: ErrInvalidOption, Message: "invalid authorization pattern " + pattern, Err: err}
+	}
+	return compiled, nil
+}
+
+// LoadAuthorizationRules reads the rules stored in path, see ParseAuthorizationRules
+func LoadAuthorizationRules(path string) (*AuthorizationRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseAuthorizationRules(file)
+}
+
+// ParseAuthorizationRules reads one rule per line, the principal pattern followed by the
+// authorization id patterns separated by whitespace. Empty lines and lines starting with
+// '#' are ignored, e.g.
+//
+//	# Hive may impersonate anyone of the realm
+//	hive/*@EXAMPLE.COM    *@EXAMPLE.COM
+//	/^etl-[0-9]+$/        reports analytics
+func ParseAuthorizationRules(reader io.Reader) (*AuthorizationRules, error) {
+	rules := NewAuthorizationRules()
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, newError("", ErrInvalidOption, "line %d: a rule needs a principal and at least one authorization id", number)
+		}
+		if err := rules.Allow(fields[0], fields[1:]...); err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,87 @@
+package gosasl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizationRules(t *testing.T) {
+	rules, err := ParseAuthorizationRules(strings.NewReader(`
+# Hive may impersonate anyone of the realm
+hive/*@EXAMPLE.COM    *@EXAMPLE.COM
+/^etl-[0-9]+$/        reports analytics
+admin                 *
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		authenticationID string
+		authorizationID  string
+		allowed          bool
+	}{
+		{"hive/node1.example.com@EXAMPLE.COM", "alice@EXAMPLE.COM", true},
+		{"hive/node1.example.com@EXAMPLE.COM", "alice@OTHER.COM", false},
+		{"hive/node1.example.com@EXAMPLE.COM", "hdfs/node1@EXAMPLE.COM", false},
+		{"hive@EXAMPLE.COM", "alice@EXAMPLE.COM", false},
+		{"hive/a@EVIL.COM/b@EXAMPLE.COM", "alice@EXAMPLE.COM", false},
+		{"etl-42", "analytics", true},
+		{"etl-42", "admin", false},
+		{"etl-x", "reports", false},
+		{"admin", "hdfs/node1@EXAMPLE.COM", true},
+		{"alice", "bob", false},
+	}
+	for _, c := range cases {
+		err := rules.Authorize(c.authenticationID, c.authorizationID)
+		if (err == nil) != c.allowed {
+			t.Fatalf("%s as %s: expected allowed %v, got %v", c.authenticationID, c.authorizationID, c.allowed, err)
+		}
+	}
+}
+
+func TestAuthorizationRulesErrors(t *testing.T) {
+	for _, content := range []string{"hive", "/[/ alice", "hive /(/"} {
+		if _, err := ParseAuthorizationRules(strings.NewReader(content)); !errors.Is(err, ErrInvalidOption) {
+			t.Fatalf("%q: expected ErrInvalidOption, got %v", content, err)
+		}
+	}
+	if _, err := LoadAuthorizationRules("/nonexistent/rules"); err == nil {
+		t.Fatal("A missing file should fail")
+	}
+}
+
+func TestAuthorizationRulesWithServer(t *testing.T) {
+	rules := NewAuthorizationRules()
+	if err := rules.Allow("proxy", "a?ice"); err != nil {
+		t.Fatal(err)
+	}
+	mechanism := NewPlainServerMechanism(VerifierFunc(func(username string, password string) (bool, error) {
+		return password == "secret", nil
+	}))
+	mechanism.Authorizer = rules
+	server := NewSaslServer(mechanism)
+	if _, err := server.Start([]byte("alice\x00proxy\x00secret")); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "proxy" || server.AuthorizationID() != "alice" {
+		t.Fatalf("Unexpected identities %q, %q", server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+
+	mechanism = NewPlainServerMechanism(VerifierFunc(func(username string, password string) (bool, error) {
+		return password == "secret", nil
+	}))
+	mechanism.Authorizer = rules
+	if _, err := NewSaslServer(mechanism).Start([]byte("bob\x00proxy\x00secret")); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Expected ErrNotAuthorized, got %v", err)
+	}
+
+	var none *AuthorizationRules
+	mechanism = NewPlainServerMechanism(VerifierFunc(func(username string, password string) (bool, error) {
+		return password == "secret", nil
+	}))
+	mechanism.Authorizer = none
+	if _, err := NewSaslServer(mechanism).Start([]byte("alice\x00proxy\x00secret")); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Nil rules should deny, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package gosasl
+
+// CallbackID identifies the piece of information a mechanism asks for
+type CallbackID int
+
+const (
+	// CallbackUsername asks for the name of the user to authenticate
+	CallbackUsername CallbackID = iota + 1
+	// CallbackPassword asks for the password of the user
+	CallbackPassword
+	// CallbackAuthorizationID asks for the identity to act as. Leaving it empty acts as
+	// the authenticated user.
+	CallbackAuthorizationID
+	// CallbackRealm asks to pick one of the realms offered by the server in Choices
+	CallbackRealm
+	// CallbackPasscode asks for a one-time passcode, e.g. when a LOGIN server prompts for one
+	// instead of the password
+	CallbackPasscode
+)
+
+// Callback is a request for information sent to a CallbackHandler. The handler answers
+// by setting Result.
+type Callback struct {
+	ID CallbackID
+	// Prompt is a human readable description of what is asked for
+	Prompt string
+	// Choices holds the values to pick from, e.g. the realms offered by the server
+	Choices []string
+	// Default is the value used if the handler leaves Result empty
+	Default string
+	Result  string
+}
+
+// CallbackHandler provides credentials lazily, only when a mechanism needs them during
+// the handshake. It is the equivalent of Cyrus sasl_interact or Java's CallbackHandler.
+type CallbackHandler interface {
+	// Handle answers all the callbacks or returns an error to abort the handshake
+	Handle(callbacks []*Callback) error
+}
+
+// CallbackHandlerFunc adapts a function to the CallbackHandler interface
+type CallbackHandlerFunc func(callbacks []*Callback) error
+
+// Handle calls f(callbacks)
+func (f CallbackHandlerFunc) Handle(callbacks []*Callback) error {
+	return f(callbacks)
+}
+
+// WithCallbackHandler sets the handler the mechanism asks for the credentials it lacks
+func WithCallbackHandler(handler CallbackHandler) Option {
+	return func(client *Client) error {
+		if handler == nil {
+			return invalidOption(client, "the callback handler is nil")
+		}
+		client.mechanism.Config().callbacks = handler
+		return nil
+	}
+}
+
+// pendingCallbacks collects the callbacks for the values a mechanism is missing
+type pendingCallbacks struct {
+	callbacks []*Callback
+	targets   []*string
+}
+
+// add asks for target only if it is empty
+func (p *pendingCallbacks) add(target *string, callback *Callback) {
+	if *target != "" {
+		return
+	}
+	p.callbacks = append(p.callbacks, callback)
+	p.targets = append(p.targets, target)
+}
+
+// interact asks the callback handler, if any, for all the pending callbacks at once and
+// stores the results
+func (c *MechanismConfig) interact(pending *pendingCallbacks) error {
+	if c.callbacks == nil || len(pending.callbacks) == 0 {
+		return nil
+	}
+	if err := c.callbacks.Handle(pending.callbacks); err != nil {
+		return &Error{Mechanism: c.name, Kind: ErrMissingCredentials, Message: "the callback handler failed", Err: err}
+	}
+	for i, callback := range pending.callbacks {
+		if callback.Result == "" {
+			callback.Result = callback.Default
+		}
+		*pending.targets[i] = callback.Result
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package gosasl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func credentialsHandler(calls *int) CallbackHandler {
+	return CallbackHandlerFunc(func(callbacks []*Callback) error {
+		*calls++
+		for _, callback := range callbacks {
+			switch callback.ID {
+			case CallbackUsername:
+				callback.Result = "user"
+			case CallbackPassword:
+				callback.Result = "pass"
+			case CallbackRealm:
+				callback.Result = callback.Choices[len(callback.Choices)-1]
+			}
+		}
+		return nil
+	})
+}
+
+func TestCallbacksAreCalledLazily(t *testing.T) {
+	calls := 0
+	client, err := NewSaslClientWithOptions("localhost", NewCramMD5Mechanism("", ""), WithCallbackHandler(credentialsHandler(&calls)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	if calls != 0 {
+		t.Fatal("The callback handler shouldn't be called before it is needed")
+	}
+	response, err := client.Step([]byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []byte("user b6f058f088b733c17d01a621a9c19dc0")
+	if calls != 1 || !reflect.DeepEqual(response, expected) {
+		t.Fatalf("Unexpected response %x after %d calls", response, calls)
+	}
+}
+
+func TestCallbacksOnlyAskForMissingValues(t *testing.T) {
+	var asked []CallbackID
+	handler := CallbackHandlerFunc(func(callbacks []*Callback) error {
+		for _, callback := range callbacks {
+			asked = append(asked, callback.ID)
+			callback.Result = "secret"
+		}
+		return nil
+	})
+	mechanism, err := NewMechanism("PLAIN", Credentials{Username: "user", AuthorizationID: "authId", Callbacks: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := mechanism.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []CallbackID{CallbackPassword}) {
+		t.Fatalf("Only the password should have been asked, got %v", asked)
+	}
+	if string(response) != "authId\x00user\x00secret" {
+		t.Fatalf("Unexpected response %q", response)
+	}
+}
+
+func TestCallbacksChooseDigestMD5Realm(t *testing.T) {
+	calls := 0
+	client, _ := NewSaslClientWithOptions("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "", ""), WithCallbackHandler(credentialsHandler(&calls)))
+	client.Start()
+	response, err := client.Step([]byte(`realm="first.example.com",realm="second.example.com",nonce="OA6MG9tEQGm2hh",qop="auth"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response), `realm="second.example.com"`) || !strings.Contains(string(response), `username="user"`) {
+		t.Fatalf("The realm and username should come from the handler: %s", response)
+	}
+}
+
+func TestCallbacksErrors(t *testing.T) {
+	handler := CallbackHandlerFunc(func(callbacks []*Callback) error {
+		return fmt.Errorf("vault unavailable")
+	})
+	client, _ := NewSaslClientWithOptions("localhost", NewPlainMechanism("", ""), WithCallbackHandler(handler))
+	if _, err := client.Start(); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("Expected ErrMissingCredentials, got %v", err)
+	}
+
+	client = NewSaslClient("localhost", NewPlainMechanism("", ""))
+	if _, err := client.Start(); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("Expected ErrMissingCredentials without a handler, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package gosasl
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// Channel binding types, see RFC 5929 and RFC 9266
+const (
+	ChannelBindingTLSUnique         = "tls-unique"
+	ChannelBindingTLSServerEndPoint = "tls-server-end-point"
+	ChannelBindingTLSExporter       = "tls-exporter"
+)
+
+// defaultChannelBinding returns the channel binding type to use on the connection,
+// tls-exporter for TLS 1.3 and tls-unique before, see RFC 9266
+func defaultChannelBinding(state *tls.ConnectionState) string {
+	if state.Version >= tls.VersionTLS13 {
+		return ChannelBindingTLSExporter
+	}
+	return ChannelBindingTLSUnique
+}
+
+// ChannelBinding returns the channel binding data of the given type for a TLS connection
+// seen from the client. Servers need TLSServerEndPoint for tls-server-end-point as their
+// own certificate isn't part of the connection state.
+func ChannelBinding(state *tls.ConnectionState, bindingType string) ([]byte, error) {
+	if state == nil || !state.HandshakeComplete {
+		return nil, newError("", ErrInvalidOption, "channel binding needs a TLS connection")
+	}
+	switch bindingType {
+	case ChannelBindingTLSUnique:
+		if len(state.TLSUnique) == 0 {
+			return nil, newError("", ErrInvalidOption, "tls-unique isn't available, e.g. with TLS 1.3 or resumed sessions")
+		}
+		return state.TLSUnique, nil
+	case ChannelBindingTLSServerEndPoint:
+		if len(state.PeerCertificates) == 0 {
+			return nil, newError("", ErrInvalidOption, "the server didn't present a certificate")
+		}
+		return TLSServerEndPoint(state.PeerCertificates[0])
+	case ChannelBindingTLSExporter:
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil, &Error{Kind: ErrInvalidOption, Message: "tls-exporter isn't available", Err: err}
+		}
+		return data, nil
+	}
+	return nil, newError("", ErrInvalidOption, "unknown channel binding type %q", bindingType)
+}
+
+// TLSServerEndPoint returns the tls-server-end-point channel binding data of the server
+// certificate, its hash with the algorithm of its signature or SHA-256 if that is MD5 or
+// SHA-1, see RFC 5929 section 4.1
+func TLSServerEndPoint(certificate *x509.Certificate) ([]byte, error) {
+	var hash crypto.Hash
+	switch certificate.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.DSAWithSHA256, x509.ECDSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	default:
+		return nil, newError("", ErrInvalidOption, "tls-server-end-point isn't defined for %s certificates", certificate.SignatureAlgorithm)
+	}
+	digest := hash.New()
+	digest.Write(certificate.Raw)
+	return digest.Sum(nil), nil
+}
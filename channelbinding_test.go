@@ -0,0 +1,113 @@
+package gosasl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// tlsPair runs a TLS handshake over a pipe and returns the states of the client and the
+// server sides
+func tlsPair(t *testing.T, version uint16) (tls.ConnectionState, tls.ConnectionState) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   version,
+		MaxVersion:   version,
+	})
+	client := tls.Client(clientConn, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+	})
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState(), server.ConnectionState()
+}
+
+func TestChannelBinding(t *testing.T) {
+	client, server := tlsPair(t, tls.VersionTLS12)
+	if defaultChannelBinding(&client) != ChannelBindingTLSUnique {
+		t.Fatal("tls-unique should be the default before TLS 1.3")
+	}
+	for _, bindingType := range []string{ChannelBindingTLSUnique, ChannelBindingTLSExporter} {
+		clientData, err := ChannelBinding(&client, bindingType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverData, err := ChannelBinding(&server, bindingType)
+		if err != nil || string(clientData) != string(serverData) || len(clientData) == 0 {
+			t.Fatalf("%s: both sides should get the same data: %v", bindingType, err)
+		}
+	}
+	data, err := ChannelBinding(&client, ChannelBindingTLSServerEndPoint)
+	expected := sha256.Sum256(client.PeerCertificates[0].Raw)
+	if err != nil || string(data) != string(expected[:]) {
+		t.Fatalf("Unexpected tls-server-end-point data: %v", err)
+	}
+
+	client, _ = tlsPair(t, tls.VersionTLS13)
+	if defaultChannelBinding(&client) != ChannelBindingTLSExporter {
+		t.Fatal("tls-exporter should be the default with TLS 1.3")
+	}
+	if _, err := ChannelBinding(&client, ChannelBindingTLSUnique); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("tls-unique isn't defined for TLS 1.3, got %v", err)
+	}
+	if _, err := ChannelBinding(&client, "tls-other"); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+	if _, err := ChannelBinding(nil, ChannelBindingTLSUnique); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	certificate := &x509.Certificate{Raw: []byte("certificate"), SignatureAlgorithm: x509.SHA1WithRSA}
+	data, err := TLSServerEndPoint(certificate)
+	expected := sha256.Sum256(certificate.Raw)
+	if err != nil || string(data) != string(expected[:]) {
+		t.Fatalf("SHA-1 certificates should be hashed with SHA-256: %v", err)
+	}
+	certificate.SignatureAlgorithm = x509.ECDSAWithSHA384
+	if data, err := TLSServerEndPoint(certificate); err != nil || len(data) != 48 {
+		t.Fatalf("Expected a SHA-384 hash: %v", err)
+	}
+	certificate.SignatureAlgorithm = x509.PureEd25519
+	if _, err := TLSServerEndPoint(certificate); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+}
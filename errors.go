@@ -0,0 +1,165 @@
+package gosasl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sentinel errors describing why a handshake failed. Errors returned by this package can
+// be matched against them with errors.Is.
+var (
+	// ErrBadCredentials means the credentials were rejected, e.g. a wrong password
+	ErrBadCredentials = errors.New("bad credentials")
+	// ErrAuthenticationFailed means the server reported a failure without the mechanism
+	// knowing why, it may be the credentials, the authorization, a lockout or anything else
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	// ErrMissingCredentials means the mechanism lacks the credentials it needs to run
+	ErrMissingCredentials = errors.New("missing credentials")
+	// ErrNotAuthorized means the authenticated identity can't act as the requested authorization identity
+	ErrNotAuthorized = errors.New("not authorized")
+	// ErrVerifier means the server failed to check the credentials, e.g. its user database is unavailable
+	ErrVerifier = errors.New("credentials can't be verified")
+	// ErrServerAuthentication means the server failed to prove its identity
+	ErrServerAuthentication = errors.New("server authentication failed")
+	// ErrProtocol means a message from the peer was malformed or unexpected
+	ErrProtocol = errors.New("protocol error")
+	// ErrQOPNegotiation means no acceptable QOP could be agreed on
+	ErrQOPNegotiation = errors.New("qop negotiation failed")
+	// ErrSecurityPolicy means the mechanism can't satisfy the security policy
+	ErrSecurityPolicy = errors.New("security policy violation")
+	// ErrUnsupportedMechanism means the mechanism is unknown or not available in this build
+	ErrUnsupportedMechanism = errors.New("unsupported mechanism")
+	// ErrInvalidOption means an Option was given an invalid value or doesn't apply to the mechanism
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrInvalidState means a method was called out of order, e.g. Step after completion
+	ErrInvalidState = errors.New("invalid state")
+	// ErrTemporarilyLocked means the server refuses to check the credentials for a while
+	// after too many failures
+	ErrTemporarilyLocked = errors.New("temporarily locked")
+)
+
+// Error is the error returned by mechanisms and clients. Kind is one of the sentinel
+// errors above and Err, when set, is the underlying cause.
+type Error struct {
+	Mechanism string
+	Kind      error
+	Message   string
+	Err       error
+}
+
+func newError(mechanism string, kind error, format string, args ...interface{}) *Error {
+	return &Error{
+		Mechanism: mechanism,
+		Kind:      kind,
+		Message:   fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Mechanism != "" {
+		msg = e.Mechanism + ": " + msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is reports whether the error is of the given kind
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StateError is returned when a Client method is called in a state that doesn't allow it
+type StateError struct {
+	Op    string
+	State State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s: %s called in state %s", ErrInvalidState, e.Op, e.State)
+}
+
+// Is reports whether target is ErrInvalidState
+func (e *StateError) Is(target error) bool {
+	return target == ErrInvalidState
+}
+
+// LockoutError is returned by the server mechanisms when too many authentication failures
+// were recorded for the identity or the address of the client. It matches
+// ErrTemporarilyLocked, not ErrBadCredentials.
+type LockoutError struct {
+	Mechanism string
+	// Identity or Address is the one that is locked, the other is empty
+	Identity string
+	Address  string
+	// Until is when the lockout ends
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	locked := "identity " + e.Identity
+	if e.Address != "" {
+		locked = "address " + e.Address
+	}
+	return fmt.Sprintf("%s: %s: too many failures for %s, retry after %s", e.Mechanism, ErrTemporarilyLocked, locked, e.Until.Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrTemporarilyLocked
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrTemporarilyLocked
+}
+
+// ScramError is the error sent by a SCRAM server in its final message, e.g. "invalid-proof".
+// It matches ErrBadCredentials when the credentials were rejected and ErrProtocol otherwise.
+type ScramError struct {
+	Mechanism string
+	// Value is the server-error-value, see RFC 5802 section 7
+	Value string
+}
+
+func (e *ScramError) Error() string {
+	return fmt.Sprintf("%s: %s: the server sent the error %s", e.Mechanism, e.kind(), e.Value)
+}
+
+// Is reports whether the error is of the given kind
+func (e *ScramError) Is(target error) bool {
+	return target == e.kind()
+}
+
+func (e *ScramError) kind() error {
+	switch e.Value {
+	case "invalid-proof", "unknown-user":
+		return ErrBadCredentials
+	}
+	return ErrProtocol
+}
+
+// GSSError is the underlying cause of errors raised by the GSS-API library. It can be
+// extracted with errors.As to inspect the major and minor status codes.
+type GSSError struct {
+	// Op is the GSS-API call that failed, e.g. "InitSecContext"
+	Op    string
+	Major uint32
+	Minor uint32
+	Err   error
+}
+
+func (e *GSSError) Error() string {
+	return fmt.Sprintf("%s failed (major %#x, minor %d): %s", e.Op, e.Major, e.Minor, e.Err)
+}
+
+// Unwrap returns the error reported by the GSS-API library
+func (e *GSSError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,58 @@
+package gosasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	_, err := NewMechanism("X-UNKNOWN", Credentials{})
+	if !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("Expected ErrUnsupportedMechanism, got %v", err)
+	}
+
+	_, err = NewMechanism("PLAIN", Credentials{})
+	if !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("Expected ErrMissingCredentials, got %v", err)
+	}
+
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "password"))
+	err = client.SetSecurityPolicy(SecurityPolicy{NoPlaintext: true})
+	if !errors.Is(err, ErrSecurityPolicy) {
+		t.Fatalf("Expected ErrSecurityPolicy, got %v", err)
+	}
+
+	transport := &scriptedTransport{messages: []serverMessage{{StatusFailed, nil}}}
+	err = client.Authenticate(context.Background(), transport)
+	if !errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrAuthenticationFailed, got %v", err)
+	}
+	var saslErr *Error
+	if !errors.As(err, &saslErr) || saslErr.Mechanism != "PLAIN" {
+		t.Fatalf("Expected an *Error for PLAIN, got %#v", err)
+	}
+}
+
+func TestDigestMD5Errors(t *testing.T) {
+	for _, challenge := range []string{"realm", `realm="unterminated`, `realm="elwood.innosoft.com",qop=auth`} {
+		client := NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "chris", "secret"))
+		client.Start()
+		if _, err := client.Step([]byte(challenge)); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("Expected ErrProtocol for %q, got %v", challenge, err)
+		}
+	}
+
+	client := NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "chris", "secret"))
+	client.Start()
+	client.Step([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth"`))
+	if _, err := client.Step([]byte("rspauth=ea40f60335c427b5527b84dbabcdfffd")); !errors.Is(err, ErrServerAuthentication) {
+		t.Fatalf("Expected ErrServerAuthentication, got %v", err)
+	}
+
+	client = NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "chris", "secret"))
+	client.Start()
+	if _, err := client.Step([]byte(`nonce="OA6MG9tEQGm2hh",qop="auth-conf"`)); !errors.Is(err, ErrQOPNegotiation) {
+		t.Fatalf("Expected ErrQOPNegotiation, got %v", err)
+	}
+}
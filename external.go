@@ -0,0 +1,166 @@
+package gosasl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"unicode/utf8"
+)
+
+// CertificateMapper maps the verified certificate of a client to its identity
+type CertificateMapper func(certificate *x509.Certificate) (string, error)
+
+// CertificateSubject maps a certificate to its subject distinguished name,
+// e.g. "CN=alice,O=Example". It is the default mapping of the EXTERNAL server.
+func CertificateSubject(certificate *x509.Certificate) (string, error) {
+	return certificate.Subject.String(), nil
+}
+
+// CertificateCommonName maps a certificate to the common name of its subject
+func CertificateCommonName(certificate *x509.Certificate) (string, error) {
+	if certificate.Subject.CommonName == "" {
+		return "", newError("EXTERNAL", ErrBadCredentials, "the certificate has no common name")
+	}
+	return certificate.Subject.CommonName, nil
+}
+
+// CertificateSAN maps a certificate to its first subject alternative name, looking at the
+// email addresses, then the DNS names and then the URIs
+func CertificateSAN(certificate *x509.Certificate) (string, error) {
+	if len(certificate.EmailAddresses) > 0 {
+		return certificate.EmailAddresses[0], nil
+	}
+	if len(certificate.DNSNames) > 0 {
+		return certificate.DNSNames[0], nil
+	}
+	if len(certificate.URIs) > 0 {
+		return certificate.URIs[0].String(), nil
+	}
+	return "", newError("EXTERNAL", ErrBadCredentials, "the certificate has no subject alternative name")
+}
+
+// ExternalMechanism corresponds to the EXTERNAL SASL mechanism, see RFC 4422 appendix A. The
+// client is authenticated outside of SASL, e.g. by its TLS certificate or the credentials of
+// a Unix socket, and only sends the authorization id of MechanismConfig, if any.
+type ExternalMechanism struct {
+	config *MechanismConfig
+}
+
+// NewExternalMechanism returns a new ExternalMechanism
+func NewExternalMechanism() *ExternalMechanism {
+	config := newDefaultConfig("EXTERNAL")
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.activeSafe = true
+	config.dictionarySafe = true
+	return &ExternalMechanism{
+		config: config,
+	}
+}
+
+func (m *ExternalMechanism) Start() ([]byte, error) {
+	return m.Step(nil)
+}
+
+// Step returns the authorization id, or an empty response to act as the identity
+// established outside of SASL. Protocols without initial responses call it with the first,
+// empty, challenge.
+func (m *ExternalMechanism) Step(challenge []byte) ([]byte, error) {
+	if len(challenge) != 0 {
+		return nil, newError(m.config.name, ErrProtocol, "the server sent a non-empty challenge")
+	}
+	m.config.complete = true
+	return []byte(m.config.AuthorizationID), nil
+}
+
+func (m *ExternalMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *ExternalMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *ExternalMechanism) Dispose() {}
+
+func (m *ExternalMechanism) Config() *MechanismConfig {
+	return m.config
+}
+
+// ExternalServerMechanism is the server side of the EXTERNAL SASL mechanism, see RFC 4422
+// appendix A. The client is authenticated by the certificate it presented during the TLS
+// handshake.
+type ExternalServerMechanism struct {
+	config *MechanismConfig
+	state  tls.ConnectionState
+	// MapIdentity turns the verified certificate of the client into its identity,
+	// CertificateSubject if nil
+	MapIdentity CertificateMapper
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+}
+
+// NewExternalServerMechanism returns a new ExternalServerMechanism for the TLS connection
+// described by state. The connection must have verified the certificate of the client, e.g.
+// with tls.RequireAndVerifyClientCert.
+func NewExternalServerMechanism(state tls.ConnectionState) *ExternalServerMechanism {
+	config := newDefaultConfig("EXTERNAL")
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.activeSafe = true
+	config.dictionarySafe = true
+	config.channelBinding = true
+	return &ExternalServerMechanism{
+		config: config,
+		state:  state,
+	}
+}
+
+// Start processes the authorization id sent by the client, clients that don't send an
+// initial response get an empty challenge
+func (m *ExternalServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+// Step takes the identity from the client certificate and checks that it can act as the
+// authorization id in the response, if any
+func (m *ExternalServerMechanism) Step(response []byte) ([]byte, error) {
+	if !utf8.Valid(response) {
+		return nil, newError(m.config.name, ErrProtocol, "the authorization id isn't valid UTF-8")
+	}
+	if !m.state.HandshakeComplete || len(m.state.VerifiedChains) == 0 || len(m.state.VerifiedChains[0]) == 0 {
+		return nil, newError(m.config.name, ErrBadCredentials, "the client didn't present a verified certificate")
+	}
+	mapIdentity := m.MapIdentity
+	if mapIdentity == nil {
+		mapIdentity = CertificateSubject
+	}
+	identity, err := mapIdentity(m.state.VerifiedChains[0][0])
+	if err != nil {
+		return nil, &Error{Mechanism: m.config.name, Kind: ErrBadCredentials, Message: "the certificate can't be mapped to an identity", Err: err}
+	}
+	if identity == "" {
+		return nil, newError(m.config.name, ErrBadCredentials, "the certificate maps to an empty identity")
+	}
+	if err := authorize(m.config, m.Authorizer, identity, string(response)); err != nil {
+		return nil, err
+	}
+	m.config.complete = true
+	return nil, nil
+}
+
+func (m *ExternalServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *ExternalServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *ExternalServerMechanism) Dispose() {}
+
+func (m *ExternalServerMechanism) Config() *MechanismConfig {
+	return m.config
+}
@@ -0,0 +1,126 @@
+package gosasl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+)
+
+func verifiedState(certificate *x509.Certificate) tls.ConnectionState {
+	return tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{certificate},
+		VerifiedChains:    [][]*x509.Certificate{{certificate}},
+	}
+}
+
+var testCertificate = &x509.Certificate{
+	Subject:        pkix.Name{CommonName: "alice", Organization: []string{"Example"}},
+	EmailAddresses: []string{"alice@example.com"},
+}
+
+func TestExternalServerMechanism(t *testing.T) {
+	server := NewSaslServer(NewExternalServerMechanism(verifiedState(testCertificate)))
+	if _, err := server.Start([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "CN=alice,O=Example" || server.AuthorizationID() != "CN=alice,O=Example" {
+		t.Fatalf("Unexpected identities %q, %q", server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+
+	for mapper, expected := range map[string]string{"cn": "alice", "san": "alice@example.com"} {
+		mechanism := NewExternalServerMechanism(verifiedState(testCertificate))
+		mechanism.MapIdentity = CertificateCommonName
+		if mapper == "san" {
+			mechanism.MapIdentity = CertificateSAN
+		}
+		server := NewSaslServer(mechanism)
+		challenge, err := server.Start(nil)
+		if err != nil || len(challenge) != 0 {
+			t.Fatalf("Expected an empty challenge, got %q: %v", challenge, err)
+		}
+		if _, err := server.Step([]byte(expected)); err != nil {
+			t.Fatal(err)
+		}
+		if server.AuthenticatedIdentity() != expected {
+			t.Fatalf("Expected %q, got %q", expected, server.AuthenticatedIdentity())
+		}
+	}
+}
+
+func TestExternalServerMechanismAuthorization(t *testing.T) {
+	mechanism := NewExternalServerMechanism(verifiedState(testCertificate))
+	mechanism.MapIdentity = CertificateCommonName
+	if _, err := NewSaslServer(mechanism).Start([]byte("admin")); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Acting as someone else should be denied by default, got %v", err)
+	}
+
+	mechanism = NewExternalServerMechanism(verifiedState(testCertificate))
+	mechanism.MapIdentity = CertificateCommonName
+	mechanism.Authorizer = AuthorizeFunc(func(authenticationID string, authorizationID string) error {
+		if authenticationID != "alice" || authorizationID != "admin" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	server := NewSaslServer(mechanism)
+	if _, err := server.Start([]byte("admin")); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "alice" || server.AuthorizationID() != "admin" {
+		t.Fatalf("Unexpected identities %q, %q", server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+}
+
+func TestExternalServerMechanismErrors(t *testing.T) {
+	unverified := verifiedState(testCertificate)
+	unverified.VerifiedChains = nil
+	if _, err := NewSaslServer(NewExternalServerMechanism(unverified)).Start([]byte{}); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("An unverified certificate should be rejected, got %v", err)
+	}
+	mechanism := NewExternalServerMechanism(verifiedState(&x509.Certificate{}))
+	mechanism.MapIdentity = CertificateSAN
+	if _, err := NewSaslServer(mechanism).Start([]byte{}); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("A certificate without SAN should be rejected, got %v", err)
+	}
+	if _, err := NewSaslServer(NewExternalServerMechanism(verifiedState(testCertificate))).Start([]byte("\xff")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Invalid UTF-8 should fail, got %v", err)
+	}
+}
+
+func TestExternalMechanism(t *testing.T) {
+	// Client first, the response is the initial response
+	client := NewSaslClient("localhost", NewExternalMechanism())
+	response, err := client.Start()
+	if err != nil || response == nil || len(response) != 0 {
+		t.Fatalf("Expected an empty initial response, got %q: %v", response, err)
+	}
+	server := NewSaslServer(NewExternalServerMechanism(verifiedState(testCertificate)))
+	if _, err := server.Start(response); err != nil || !server.Complete() {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+	if _, err := client.Step(nil); err != nil || client.State() != StateComplete {
+		t.Fatalf("The client should be complete: %v", err)
+	}
+
+	// Server first, the response is sent in reply to the empty challenge
+	mechanism := NewExternalMechanism()
+	mechanism.Config().AuthorizationID = "bob"
+	client = NewSaslClient("localhost", mechanism)
+	client.Start()
+	if client.State() != StateInProgress {
+		t.Fatal("The client should wait for the server")
+	}
+	response, err = client.Step([]byte{})
+	if err != nil || string(response) != "bob" || client.State() != StateComplete {
+		t.Fatalf("Expected the authorization id, got %q: %v", response, err)
+	}
+
+	client = NewSaslClient("localhost", NewExternalMechanism())
+	client.Start()
+	if _, err := client.Step([]byte("challenge")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package gosasl
+
+import (
+	"strings"
+)
+
+// gs2Header is the header that starts the first message of the GS2 family of mechanisms,
+// OAUTHBEARER and SCRAM, see RFC 5801 section 4
+type gs2Header struct {
+	// cbindFlag is "n" if the client doesn't support channel binding, "y" if it does but
+	// thinks the server doesn't and "p" if it uses it
+	cbindFlag string
+	// cbindName is the channel binding type when cbindFlag is "p"
+	cbindName string
+	// authorizationID is the unescaped authzid, empty if the client didn't send one
+	authorizationID string
+	// raw is the header as sent, including the trailing comma
+	raw string
+}
+
+// parseGS2Header splits a client first message into its GS2 header and the rest
+func parseGS2Header(mechanism string, message string) (gs2Header, string, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return gs2Header{}, "", newError(mechanism, ErrProtocol, "the GS2 header is incomplete")
+	}
+	header := gs2Header{raw: parts[0] + "," + parts[1] + ","}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+		header.cbindFlag = parts[0]
+	case strings.HasPrefix(parts[0], "p=") && len(parts[0]) > 2:
+		header.cbindFlag = "p"
+		header.cbindName = parts[0][2:]
+	default:
+		return gs2Header{}, "", newError(mechanism, ErrProtocol, "invalid channel binding flag %q", parts[0])
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return gs2Header{}, "", newError(mechanism, ErrProtocol, "invalid authorization id %q", parts[1])
+		}
+		authorizationID, err := decodeSaslName(mechanism, parts[1][2:])
+		if err != nil {
+			return gs2Header{}, "", err
+		}
+		header.authorizationID = authorizationID
+	}
+	return header, parts[2], nil
+}
+
+// encodeSaslName escapes the commas and equal signs of a name, see RFC 5802 section 5.1
+func encodeSaslName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// decodeSaslName reverses encodeSaslName, any other escape sequence is an error
+func decodeSaslName(mechanism string, name string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == ',':
+			return "", newError(mechanism, ErrProtocol, "unescaped comma in %q", name)
+		case name[i] != '=':
+			decoded.WriteByte(name[i])
+		case strings.HasPrefix(name[i:], "=2C"):
+			decoded.WriteByte(',')
+			i += 2
+		case strings.HasPrefix(name[i:], "=3D"):
+			decoded.WriteByte('=')
+			i += 2
+		default:
+			return "", newError(mechanism, ErrProtocol, "invalid escape sequence in %q", name)
+		}
+	}
+	return decoded.String(), nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/beltran/gssapi"
 )
@@ -26,13 +27,44 @@ type GSSAPIMechanism struct {
 	serverMaxLength  int
 	UserSelectQop    uint8
 	MaxLength        int
+	// ServiceHost is the host of the service principal, when it differs from the host
+	// the client connects to. It can be set with WithServiceHost.
+	ServiceHost string
+}
+
+func init() {
+	RegisterMechanism("GSSAPI", func(credentials Credentials) (Mechanism, error) {
+		if credentials.Service == "" {
+			return nil, newError("GSSAPI", ErrMissingCredentials, "a service is required")
+		}
+		mechanism, err := NewGSSAPIMechanism(credentials.Service)
+		if err != nil {
+			return nil, err
+		}
+		if err := acquireClientCredentials(mechanism.context); err != nil {
+			mechanism.Dispose()
+			return nil, &Error{Mechanism: "GSSAPI", Kind: ErrMissingCredentials, Message: "no Kerberos ticket is available", Err: err}
+		}
+		return mechanism, nil
+	})
 }
 
 // NewGSSAPIMechanism returns a new GSSAPIMechanism
 func NewGSSAPIMechanism(service string) (mechanism *GSSAPIMechanism, err error) {
-	context := newGSSAPIContext()
+	context, err := newGSSAPIContext(false, "")
+	if err != nil {
+		return nil, err
+	}
+	config := newDefaultConfig("GSSAPI")
+	config.score = 100
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.activeSafe = true
+	config.dictionarySafe = true
+	config.mutualAuth = true
+	config.qop = QOP{QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_CONF] | QOP_TO_FLAG[AUTH_INT]}
 	mechanism = &GSSAPIMechanism{
-		config:           newDefaultConfig("GSSAPI"),
+		config:           config,
 		service:          service,
 		negotiationStage: 0,
 		context:          context,
@@ -43,16 +75,19 @@ func NewGSSAPIMechanism(service string) (mechanism *GSSAPIMechanism, err error)
 	return
 }
 
-func (m *GSSAPIMechanism) start() ([]byte, error) {
-	return m.step(nil)
+func (m *GSSAPIMechanism) Start() ([]byte, error) {
+	return m.Step(nil)
 }
 
-func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
+func (m *GSSAPIMechanism) Step(challenge []byte) ([]byte, error) {
 	var serviceHostQualified string
 	var fullServiceName string
 	// Allows to use a service principal designated for another host to still be used.
 	// Useful for containerized environments.
-	serviceHostQualified = os.Getenv("SERVICE_HOST_QUALIFIED")
+	serviceHostQualified = m.ServiceHost
+	if serviceHostQualified == "" {
+		serviceHostQualified = os.Getenv("SERVICE_HOST_QUALIFIED")
+	}
 	if len(serviceHostQualified) > 0 {
 		fullServiceName = m.service + "/" + serviceHostQualified
 	} else {
@@ -61,16 +96,16 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 
 	if m.negotiationStage == 0 {
 		err := initClientContext(m.context, fullServiceName, nil)
-		if err == gssapi.ErrContinueNeeded {
-			err = nil
+		if err != nil && err != gssapi.ErrContinueNeeded {
+			return nil, newGSSError(m.config.name, "InitSecContext", err)
 		}
 		m.negotiationStage = 1
-		return m.context.token, err
+		return m.context.token, nil
 
 	} else if m.negotiationStage == 1 {
 		err := initClientContext(m.context, fullServiceName, challenge)
 		if err != nil && err != gssapi.ErrContinueNeeded {
-			return nil, err
+			return nil, newGSSError(m.config.name, "InitSecContext", err)
 		}
 
 		var srcName *gssapi.Name
@@ -84,7 +119,10 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 			// Check if the context is available. If the user has set the flags
 			// it will fail, although at this point we could know that the negotiation won't succeed
 			if !m.context.integAvail() && !m.context.confAvail() {
-				log.Println("No security layer can be established, authentication is still possible")
+				m.config.logf("No security layer can be established, authentication is still possible")
+			}
+			if m.config.policy != nil && m.config.policy.MutualAuth && !m.context.mutualAvail() {
+				return nil, newError(m.config.name, ErrServerAuthentication, "mutual authentication is not available")
 			}
 			m.negotiationStage = 2
 		}
@@ -92,10 +130,10 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 	} else if m.negotiationStage == 2 {
 		data, err := m.context.unwrap(challenge)
 		if err != nil {
-			return nil, err
+			return nil, newGSSError(m.config.name, "Unwrap", err)
 		}
 		if len(data) != 4 {
-			return nil, fmt.Errorf("Decoded data should have length for at this stage")
+			return nil, newError(m.config.name, ErrProtocol, "decoded data should have length four at this stage")
 		}
 		qopBits := data[0]
 		data[0] = 0
@@ -104,8 +142,12 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 		m.qop, err = m.selectQop(qopBits)
 		// The client doesn't support or want any of the security layers offered by the server
 		if err != nil {
+			if m.config.policy != nil && m.config.policy.MinSSF > 0 {
+				return nil, err
+			}
 			m.MaxLength = 0
 		}
+		m.config.negotiatedQop = m.qop
 
 		header := make([]byte, 4)
 		maxLength := m.serverMaxLength
@@ -114,6 +156,8 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 		}
 
 		headerInt := (uint(m.qop) << 24) | uint(maxLength)
+		m.config.maxBuffer = maxLength
+		m.config.peerMaxBuffer = m.serverMaxLength
 
 		binary.BigEndian.PutUint32(header, uint32(headerInt))
 
@@ -124,21 +168,25 @@ func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
 		}
 		out := append(header, []byte(name)...)
 		wrappedOut, err := m.context.wrap(out, false)
+		if err != nil {
+			return nil, newGSSError(m.config.name, "Wrap", err)
+		}
 
 		m.config.complete = true
-		return wrappedOut, err
+		m.config.identity = m.user
+		return wrappedOut, nil
 	}
-	return nil, fmt.Errorf("Error, this code should be unreachable")
+	return nil, newError(m.config.name, ErrProtocol, "unexpected step after the negotiation")
 }
 
 func (m *GSSAPIMechanism) selectQop(qopByte byte) (byte, error) {
-	availableQops := m.UserSelectQop & m.supportedQop & qopByte
+	availableQops := m.UserSelectQop & m.supportedQop & qopByte & m.config.policy.allowedQop()
 	for _, qop := range []byte{QOP_TO_FLAG[AUTH_CONF], QOP_TO_FLAG[AUTH_INT], QOP_TO_FLAG[AUTH]} {
 		if qop&availableQops != 0 {
 			return qop, nil
 		}
 	}
-	return byte(0), fmt.Errorf("No qop satisfying all the conditions where found")
+	return byte(0), newError(m.config.name, ErrQOPNegotiation, "no qop satisfying all the conditions was found")
 }
 
 // replaceSPNHostWildcard substitutes the special string '_HOST' in the given
@@ -151,7 +199,7 @@ func replaceSPNHostWildcard(spn, host string) string {
 	return spn[:res[2]] + host + spn[res[3]:]
 }
 
-func (m GSSAPIMechanism) encode(outgoing []byte) ([]byte, error) {
+func (m GSSAPIMechanism) Encode(outgoing []byte) ([]byte, error) {
 	if m.qop == QOP_TO_FLAG[AUTH] {
 		return outgoing, nil
 	} else {
@@ -159,15 +207,39 @@ func (m GSSAPIMechanism) encode(outgoing []byte) ([]byte, error) {
 		if m.qop == QOP_TO_FLAG[AUTH_CONF] {
 			conf_flag = true
 		}
-		return m.context.wrap(deepCopy(outgoing), conf_flag)
+		wrapped, err := m.context.wrap(deepCopy(outgoing), conf_flag)
+		if err != nil {
+			return nil, newGSSError(m.config.name, "Wrap", err)
+		}
+		return wrapped, nil
 	}
 }
 
-func (m GSSAPIMechanism) decode(incoming []byte) ([]byte, error) {
+func (m GSSAPIMechanism) Decode(incoming []byte) ([]byte, error) {
 	if m.qop == QOP_TO_FLAG[AUTH] {
 		return incoming, nil
 	}
-	return m.context.unwrap(deepCopy(incoming))
+	unwrapped, err := m.context.unwrap(deepCopy(incoming))
+	if err != nil {
+		return nil, newGSSError(m.config.name, "Unwrap", err)
+	}
+	return unwrapped, nil
+}
+
+// newGSSError wraps an error returned by the GSS-API library. Failures caused by the
+// credentials are reported as ErrBadCredentials, any other as ErrProtocol.
+func newGSSError(mechanism string, op string, err error) error {
+	cause := &GSSError{Op: op, Err: err}
+	kind := ErrProtocol
+	if gssErr, ok := err.(*gssapi.Error); ok {
+		cause.Major = uint32(gssErr.Major)
+		cause.Minor = uint32(gssErr.Minor)
+		switch gssErr.Major.RoutineError() {
+		case gssapi.GSS_S_NO_CRED, gssapi.GSS_S_DEFECTIVE_CREDENTIAL, gssapi.GSS_S_CREDENTIALS_EXPIRED:
+			kind = ErrBadCredentials
+		}
+	}
+	return &Error{Mechanism: mechanism, Kind: kind, Err: cause}
 }
 
 func deepCopy(original []byte) []byte {
@@ -178,11 +250,185 @@ func deepCopy(original []byte) []byte {
 	return copied
 }
 
-func (m GSSAPIMechanism) dispose() {
+func (m GSSAPIMechanism) Dispose() {
 	m.context.dispose()
 }
 
-func (m GSSAPIMechanism) getConfig() *MechanismConfig {
+func (m GSSAPIMechanism) Config() *MechanismConfig {
+	return m.config
+}
+
+// GSSAPIServerMechanism is the server side of the GSSAPI mechanism, it accepts the
+// clients with the service credentials of a keytab
+type GSSAPIServerMechanism struct {
+	config           *MechanismConfig
+	context          *GSSAPIContext
+	negotiationStage int
+	qop              byte
+	offeredQop       byte
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+	// UserSelectQop are the security layers offered to the client, if the context allows them
+	UserSelectQop uint8
+	// MaxLength is the largest buffer the server accepts once a security layer is established
+	MaxLength int
+}
+
+// NewGSSAPIServerMechanism returns a new GSSAPIServerMechanism for the service principal,
+// e.g. "hive/server.example.com@EXAMPLE.COM", whose key is in keytab. The default keytab is
+// used if keytab is empty, any principal in it is accepted if principal is empty. The
+// keytab is set through KRB5_KTNAME so it applies to the whole process.
+func NewGSSAPIServerMechanism(principal string, keytab string) (*GSSAPIServerMechanism, error) {
+	context, err := newGSSAPIContext(true, keytab)
+	if err != nil {
+		return nil, err
+	}
+	context.ServiceName = principal
+	if err := acquireServiceCredentials(context); err != nil {
+		return nil, newGSSError("GSSAPI", "AcquireCred", err)
+	}
+	config := newDefaultConfig("GSSAPI")
+	config.score = 100
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.activeSafe = true
+	config.dictionarySafe = true
+	config.mutualAuth = true
+	config.qop = QOP{QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_CONF] | QOP_TO_FLAG[AUTH_INT]}
+	return &GSSAPIServerMechanism{
+		config:        config,
+		context:       context,
+		MaxLength:     DEFAULT_MAX_LENGTH,
+		UserSelectQop: QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT] | QOP_TO_FLAG[AUTH_CONF],
+	}, nil
+}
+
+// Start processes the first token of the client, clients that don't send an initial
+// response get an empty challenge
+func (m *GSSAPIServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if len(initialResponse) == 0 {
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+// Step establishes the security context and then negotiates the security layer as
+// described in RFC 4752
+func (m *GSSAPIServerMechanism) Step(response []byte) ([]byte, error) {
+	switch m.negotiationStage {
+	case 0:
+		user, err := acceptServerContext(m.context, response)
+		if err != nil {
+			return nil, newGSSError(m.config.name, "AcceptSecContext", err)
+		}
+		if !m.context.continueNeeded {
+			m.config.identity = user
+			if len(m.context.token) == 0 {
+				// Without mutual authentication there is no final token for the client to
+				// answer, the offer follows right away, see RFC 4752 section 3.1
+				return m.securityLayerOffer()
+			}
+			// The client answers the last token with an empty response
+			m.negotiationStage = 1
+		}
+		return m.context.token, nil
+
+	case 1:
+		return m.securityLayerOffer()
+
+	case 2:
+		data, err := m.context.unwrap(response)
+		if err != nil {
+			return nil, newGSSError(m.config.name, "Unwrap", err)
+		}
+		if len(data) < 4 {
+			return nil, newError(m.config.name, ErrProtocol, "decoded data should have at least length four at this stage")
+		}
+		qop := data[0]
+		if qop&m.offeredQop == 0 || qop&(qop-1) != 0 {
+			return nil, newError(m.config.name, ErrQOPNegotiation, "the client chose a security layer that wasn't offered: %d", qop)
+		}
+		data[0] = 0
+		peerMaxLength := int(binary.BigEndian.Uint32(data[:4]))
+		authorizationID := string(data[4:])
+		if !utf8.ValidString(authorizationID) {
+			return nil, newError(m.config.name, ErrProtocol, "the authorization id isn't valid UTF-8")
+		}
+		if err := authorize(m.config, m.Authorizer, m.config.identity, authorizationID); err != nil {
+			return nil, err
+		}
+		m.qop = qop
+		m.config.negotiatedQop = qop
+		if qop != QOP_TO_FLAG[AUTH] {
+			m.config.maxBuffer = m.MaxLength
+			m.config.peerMaxBuffer = peerMaxLength
+		}
+		m.negotiationStage = 3
+		m.config.complete = true
+		return nil, nil
+	}
+	return nil, newError(m.config.name, ErrProtocol, "unexpected step after the negotiation")
+}
+
+// securityLayerOffer returns the wrapped security layers and max buffer size offered to
+// the client once the context is established
+func (m *GSSAPIServerMechanism) securityLayerOffer() ([]byte, error) {
+	m.offeredQop = QOP_TO_FLAG[AUTH]
+	if m.context.integAvail() {
+		m.offeredQop |= QOP_TO_FLAG[AUTH_INT]
+	}
+	if m.context.confAvail() {
+		m.offeredQop |= QOP_TO_FLAG[AUTH_CONF]
+	}
+	m.offeredQop &= m.UserSelectQop & m.config.policy.allowedQop()
+	if m.offeredQop == 0 {
+		return nil, newError(m.config.name, ErrQOPNegotiation, "no security layer can be offered")
+	}
+	maxLength := m.MaxLength
+	if m.offeredQop == QOP_TO_FLAG[AUTH] {
+		maxLength = 0
+	}
+	offer := make([]byte, 4)
+	binary.BigEndian.PutUint32(offer, uint32(maxLength))
+	offer[0] = m.offeredQop
+	wrapped, err := m.context.wrap(offer, false)
+	if err != nil {
+		return nil, newGSSError(m.config.name, "Wrap", err)
+	}
+	m.negotiationStage = 2
+	return wrapped, nil
+}
+
+// Encode wraps the outgoing bytes with the negotiated security layer
+func (m *GSSAPIServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	if m.qop == QOP_TO_FLAG[AUTH] {
+		return outgoing, nil
+	}
+	wrapped, err := m.context.wrap(deepCopy(outgoing), m.qop == QOP_TO_FLAG[AUTH_CONF])
+	if err != nil {
+		return nil, newGSSError(m.config.name, "Wrap", err)
+	}
+	return wrapped, nil
+}
+
+// Decode unwraps the incoming bytes with the negotiated security layer
+func (m *GSSAPIServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	if m.qop == QOP_TO_FLAG[AUTH] {
+		return incoming, nil
+	}
+	unwrapped, err := m.context.unwrap(deepCopy(incoming))
+	if err != nil {
+		return nil, newGSSError(m.config.name, "Unwrap", err)
+	}
+	return unwrapped, nil
+}
+
+// Dispose releases the security context and the service credentials
+func (m *GSSAPIServerMechanism) Dispose() {
+	m.context.dispose()
+}
+
+func (m *GSSAPIServerMechanism) Config() *MechanismConfig {
 	return m.config
 }
 
@@ -206,20 +452,26 @@ type GSSAPIContext struct {
 	availFlags     uint32
 }
 
-//
-func newGSSAPIContext() *GSSAPIContext {
+// newGSSAPIContext loads the GSS-API library. A keytab, if given, is where the service
+// credentials are read from.
+func newGSSAPIContext(runAsService bool, keytab string) (*GSSAPIContext, error) {
 	var c = &GSSAPIContext{
-		reqFlags: uint32(gssapi.GSS_C_INTEG_FLAG) + uint32(gssapi.GSS_C_MUTUAL_FLAG) + uint32(gssapi.GSS_C_SEQUENCE_FLAG) + uint32(gssapi.GSS_C_CONF_FLAG),
+		RunAsService: runAsService,
+		reqFlags:     uint32(gssapi.GSS_C_INTEG_FLAG) + uint32(gssapi.GSS_C_MUTUAL_FLAG) + uint32(gssapi.GSS_C_SEQUENCE_FLAG) + uint32(gssapi.GSS_C_CONF_FLAG),
 	}
+	c.Krb5Ktname = keytab
 	prefix := "gosasl-client"
+	if runAsService {
+		prefix = "gosasl-server"
+	}
 	err := loadlib(c.DebugLog, prefix, c)
 	if err != nil {
-		log.Fatal(err)
+		return nil, &Error{Mechanism: "GSSAPI", Kind: ErrUnsupportedMechanism, Message: "the GSS-API library can't be loaded", Err: err}
 	}
 
 	j, _ := json.MarshalIndent(c, "", "  ")
 	c.Debug(fmt.Sprintf("Config: %s", string(j)))
-	return c
+	return c, nil
 }
 
 // InitClientContext initializes the context and gets the response(token)
@@ -239,7 +491,10 @@ func initClientContext(c *GSSAPIContext, service string, inputToken []byte) erro
 		}
 	}
 
-	preparedName := prepareServiceName(c)
+	preparedName, err := prepareServiceName(c)
+	if err != nil {
+		return err
+	}
 	defer preparedName.Release()
 
 	// Error is purposedly ignored.
@@ -260,6 +515,68 @@ func initClientContext(c *GSSAPIContext, service string, inputToken []byte) erro
 	return err
 }
 
+// acquireClientCredentials checks that the default credentials of the client, usually a
+// ticket in the credentials cache, are available to initiate a context
+func acquireClientCredentials(c *GSSAPIContext) error {
+	credential, actualMechs, _, err := c.AcquireCred(c.GSS_C_NO_NAME(), gssapi.GSS_C_INDEFINITE, c.GSS_C_NO_OID_SET, gssapi.GSS_C_INITIATE)
+	actualMechs.Release()
+	if err != nil {
+		return err
+	}
+	return credential.Release()
+}
+
+// acquireServiceCredentials loads the credentials of the service from the keytab. Without
+// a service name any principal of the keytab is accepted.
+func acquireServiceCredentials(c *GSSAPIContext) error {
+	name := c.GSS_C_NO_NAME()
+	if c.ServiceName != "" {
+		var err error
+		if name, err = prepareServiceName(c); err != nil {
+			return err
+		}
+		defer name.Release()
+	}
+	credential, actualMechs, _, err := c.AcquireCred(name, gssapi.GSS_C_INDEFINITE, c.GSS_C_NO_OID_SET, gssapi.GSS_C_ACCEPT)
+	actualMechs.Release()
+	if err != nil {
+		return err
+	}
+	c.credential = credential
+	return nil
+}
+
+// acceptServerContext processes a token of the client and gets the response(token)
+// to send back. Once the context is established the name of the client is returned.
+func acceptServerContext(c *GSSAPIContext, inputToken []byte) (string, error) {
+	_inputToken, err := c.MakeBufferBytes(inputToken)
+	defer _inputToken.Release()
+	if err != nil {
+		return "", err
+	}
+
+	contextId, srcName, _, token, retFlags, _, delegatedCredHandle, err := c.AcceptSecContext(
+		c.contextId,
+		c.credential,
+		_inputToken,
+		c.GSS_C_NO_CHANNEL_BINDINGS)
+	defer token.Release()
+	defer srcName.Release()
+	defer delegatedCredHandle.Release()
+	if err != nil && err != gssapi.ErrContinueNeeded {
+		return "", err
+	}
+
+	c.token = token.Bytes()
+	c.contextId = contextId
+	c.availFlags = retFlags
+	c.continueNeeded = err == gssapi.ErrContinueNeeded
+	if c.continueNeeded {
+		return "", nil
+	}
+	return srcName.String(), nil
+}
+
 // Wrap calls GSS_Wrap
 func (c *GSSAPIContext) wrap(original []byte, conf_flag bool) (wrapped []byte, err error) {
 	if original == nil {
@@ -300,6 +617,10 @@ func (c *GSSAPIContext) unwrap(original []byte) (unwrapped []byte, err error) {
 
 // Dispose releases the acquired memory and destroys sensitive information
 func (c *GSSAPIContext) dispose() error {
+	if c.credential != nil {
+		c.credential.Release()
+		c.credential = nil
+	}
 	if c.contextId != nil {
 		return c.contextId.Unload()
 	}
@@ -311,6 +632,11 @@ func (c *GSSAPIContext) integAvail() bool {
 	return c.availFlags&uint32(gssapi.GSS_C_INTEG_FLAG) != 0
 }
 
+// MutualAvail returns true if the server has authenticated itself to the client
+func (c *GSSAPIContext) mutualAvail() bool {
+	return c.availFlags&uint32(gssapi.GSS_C_MUTUAL_FLAG) != 0
+}
+
 // ConfAvail returns true in the conf_flag is available and therefore a confidentiality layer can be established
 func (c *GSSAPIContext) confAvail() bool {
 	return c.availFlags&uint32(gssapi.GSS_C_CONF_FLAG) != 0
@@ -338,24 +664,25 @@ func loadlib(debug bool, prefix string, c *GSSAPIContext) error {
 	return nil
 }
 
-func prepareServiceName(c *GSSAPIContext) *gssapi.Name {
+func prepareServiceName(c *GSSAPIContext) (*gssapi.Name, error) {
 	if c.ServiceName == "" {
-		log.Fatal("Need a --service-name")
+		return nil, fmt.Errorf("a service name is needed")
 	}
 
 	nameBuf, err := c.MakeBufferString(c.ServiceName)
-	defer nameBuf.Release()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer nameBuf.Release()
 
 	name, err := nameBuf.Name(c.GSS_KRB5_NT_PRINCIPAL_NAME)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if name.String() != c.ServiceName {
-		log.Fatalf("name: got %q, expected %q", name.String(), c.ServiceName)
+	if got := name.String(); got != c.ServiceName {
+		name.Release()
+		return nil, fmt.Errorf("name: got %q, expected %q", got, c.ServiceName)
 	}
 
-	return name
+	return name, nil
 }
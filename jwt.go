@@ -0,0 +1,300 @@
+package gosasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// TokenValidator checks the bearer tokens received by the OAUTHBEARER server
+type TokenValidator interface {
+	// ValidateToken returns the identity the token was issued to, or an error if the token
+	// isn't valid
+	ValidateToken(token string) (subject string, err error)
+}
+
+// TokenValidatorFunc adapts a function to the TokenValidator interface
+type TokenValidatorFunc func(token string) (string, error)
+
+// ValidateToken calls f(token)
+func (f TokenValidatorFunc) ValidateToken(token string) (string, error) {
+	return f(token)
+}
+
+// JWTValidator validates JSON Web Tokens, RFC 7519, signed with HS256, RS256 or ES256.
+// Tokens must have an expiration time.
+type JWTValidator struct {
+	// Keys are the keys trusted to sign the tokens indexed by key id, the "kid" header of
+	// the tokens. They are []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey
+	// for ES256. A token without key id can use the only key if there is just one.
+	Keys map[string]interface{}
+	// Issuer is the required "iss" claim, not checked if empty
+	Issuer string
+	// Audience must be in the "aud" claim, not checked if empty
+	Audience string
+	// SubjectClaim is the claim holding the identity, "sub" if empty
+	SubjectClaim string
+	// Leeway is the clock skew tolerated when checking "exp" and "nbf"
+	Leeway time.Duration
+	// Now is the clock used to check "exp" and "nbf", time.Now if nil
+	Now func() time.Time
+}
+
+// NewJWTValidator returns a new JWTValidator trusting keys
+func NewJWTValidator(keys map[string]interface{}) *JWTValidator {
+	return &JWTValidator{
+		Keys: keys,
+	}
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// ValidateToken checks the signature and the claims of the token and returns its subject
+func (v *JWTValidator) ValidateToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", jwtError("the token isn't a JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", jwtError("the signature isn't valid base64url")
+	}
+	key := v.Keys[header.KeyID]
+	if key == nil && header.KeyID == "" && len(v.Keys) == 1 {
+		for _, only := range v.Keys {
+			key = only
+		}
+	}
+	if key == nil {
+		return "", jwtError("unknown key %q", header.KeyID)
+	}
+	if err := verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	return v.checkClaims(claims)
+}
+
+// checkClaims checks the validity period, the issuer and the audience of the token
+func (v *JWTValidator) checkClaims(claims map[string]interface{}) (string, error) {
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	expiration, ok := claims["exp"].(float64)
+	if !ok {
+		return "", jwtError("the token has no expiration time")
+	}
+	if now().Add(-v.Leeway).After(time.Unix(int64(expiration), 0)) {
+		return "", jwtError("the token has expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now().Add(v.Leeway).Before(time.Unix(int64(notBefore), 0)) {
+		return "", jwtError("the token isn't valid yet")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return "", jwtError("unexpected issuer %v", claims["iss"])
+	}
+	if v.Audience != "" && !jwtAudienceContains(claims["aud"], v.Audience) {
+		return "", jwtError("the token isn't meant for %s", v.Audience)
+	}
+	subjectClaim := v.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+	subject, _ := claims[subjectClaim].(string)
+	if subject == "" {
+		return "", jwtError("the token has no %q claim", subjectClaim)
+	}
+	return subject, nil
+}
+
+// jwtAudienceContains returns true if the "aud" claim, a string or an array of them,
+// contains audience
+func jwtAudienceContains(claim interface{}, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []interface{}:
+		for _, value := range claim {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks the signature of the signing input with a key of the type
+// required by the algorithm
+func verifyJWTSignature(algorithm string, key interface{}, input string, signature []byte) error {
+	digest := sha256.Sum256([]byte(input))
+	switch algorithm {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return jwtError("the key can't be used with %s", algorithm)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return jwtError("invalid signature")
+		}
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return jwtError("the key can't be used with %s", algorithm)
+		}
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return jwtError("invalid signature")
+		}
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return jwtError("the key can't be used with %s", algorithm)
+		}
+		if len(signature) != 64 {
+			return jwtError("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return jwtError("invalid signature")
+		}
+	default:
+		return jwtError("unsupported algorithm %q", algorithm)
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return jwtError("the token isn't valid base64url")
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return jwtError("the token isn't valid JSON")
+	}
+	return nil
+}
+
+func jwtError(format string, args ...interface{}) error {
+	return newError("OAUTHBEARER", ErrBadCredentials, format, args...)
+}
+
+// jsonWebKey is a key of a JWK set, RFC 7517
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	// Parameters of RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// Parameters of elliptic curve keys
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	// Parameter of symmetric keys
+	K string `json:"k"`
+}
+
+// LoadJWKS reads the keys of the JWK set stored in path, in the format expected by
+// JWTValidator.Keys. Keys that aren't meant for signatures are skipped.
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parses the keys of a JWK set in the format expected by JWTValidator.Keys. Keys
+// that aren't meant for signatures are skipped.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, newError("OAUTHBEARER", ErrInvalidOption, "invalid JWK set: %v", err)
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+// key returns the key in the format expected by JWTValidator.Keys
+func (jwk jsonWebKey) key() (interface{}, error) {
+	switch jwk.KeyType {
+	case "oct":
+		return decodeJWKParameter(jwk, "k", jwk.K)
+	case "RSA":
+		n, err := decodeJWKParameter(jwk, "n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKParameter(jwk, "e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, newError("OAUTHBEARER", ErrInvalidOption, "key %q has an invalid exponent", jwk.KeyID)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, newError("OAUTHBEARER", ErrInvalidOption, "key %q uses the unsupported curve %q", jwk.KeyID, jwk.Curve)
+		}
+		x, err := decodeJWKParameter(jwk, "x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKParameter(jwk, "y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, newError("OAUTHBEARER", ErrInvalidOption, "key %q isn't on its curve", jwk.KeyID)
+		}
+		return key, nil
+	}
+	return nil, newError("OAUTHBEARER", ErrInvalidOption, "key %q has the unsupported type %q", jwk.KeyID, jwk.KeyType)
+}
+
+func decodeJWKParameter(jwk jsonWebKey, name string, value string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return nil, newError("OAUTHBEARER", ErrInvalidOption, "key %q has an invalid %q parameter", jwk.KeyID, name)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,278 @@
+package gosasl
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// FailureStore keeps the count of the recent authentication failures of each key, an
+// identity or a remote address. It can be shared by several servers, e.g. backed by a
+// database, to enforce the limits across them.
+type FailureStore interface {
+	// Failures returns the failures recorded for key and the time of the last one
+	Failures(key string) (count int, last time.Time, err error)
+	// RecordFailure increments the failures of key and returns the new count. It must be
+	// atomic, concurrent calls for the same key never return the same count.
+	RecordFailure(key string, at time.Time) (count int, err error)
+	// CancelFailure takes back a failure recorded with RecordFailure, for an attempt that
+	// didn't fail after all
+	CancelFailure(key string) error
+	// Reset forgets the failures of key
+	Reset(key string) error
+}
+
+// MemoryFailureStore is a FailureStore local to the process
+type MemoryFailureStore struct {
+	mutex   sync.Mutex
+	entries map[string]failureEntry
+	records int
+	// Retention is how long the failures of a key are kept after the last one, 24 hours
+	// if zero
+	Retention time.Duration
+}
+
+type failureEntry struct {
+	count int
+	last  time.Time
+	// previous is the time of the failure before last, restored by CancelFailure
+	previous time.Time
+}
+
+// NewMemoryFailureStore returns an empty MemoryFailureStore
+func NewMemoryFailureStore() *MemoryFailureStore {
+	return &MemoryFailureStore{
+		entries: make(map[string]failureEntry),
+	}
+}
+
+func (s *MemoryFailureStore) Failures(key string) (int, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[key]
+	return entry.count, entry.last, nil
+}
+
+func (s *MemoryFailureStore) RecordFailure(key string, at time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Sweep the expired keys now and then so that the failures of many addresses don't
+	// accumulate
+	if s.records++; s.records%1000 == 0 {
+		retention := s.Retention
+		if retention == 0 {
+			retention = 24 * time.Hour
+		}
+		for expired, entry := range s.entries {
+			if at.Sub(entry.last) > retention {
+				delete(s.entries, expired)
+			}
+		}
+	}
+	entry := s.entries[key]
+	entry.count++
+	entry.previous, entry.last = entry.last, at
+	s.entries[key] = entry
+	return entry.count, nil
+}
+
+func (s *MemoryFailureStore) CancelFailure(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.count <= 1 {
+		delete(s.entries, key)
+		return nil
+	}
+	entry.count--
+	entry.last = entry.previous
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemoryFailureStore) Reset(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// BruteForceGuard protects the server side of password mechanisms against guessing. After
+// each failure the server waits before answering, twice as long as after the previous one,
+// and once an identity or an address reaches MaxFailures it is locked out for
+// LockoutDuration. The failures of a key are forgotten after LockoutDuration without new
+// ones, those of an identity also when it authenticates successfully. Each attempt is
+// recorded as a failure before the credentials are checked and cancelled if they match,
+// so that concurrent attempts can't exceed MaxFailures.
+//
+// The server mechanisms checking passwords have a Guard field, nil to disable the
+// protection, and a RemoteAddress field with the address of the client to count its
+// failures too.
+type BruteForceGuard struct {
+	store FailureStore
+	// MaxFailures is the number of failures that locks an identity or an address, 5 if zero
+	MaxFailures int
+	// LockoutDuration is how long the lockout lasts, 15 minutes if zero
+	LockoutDuration time.Duration
+	// Delay is the wait after the first failure, 500 milliseconds if zero
+	Delay time.Duration
+	// MaxDelay caps the wait after a failure, 8 seconds if zero
+	MaxDelay time.Duration
+	// Now is the clock used to time the failures, time.Now if nil
+	Now func() time.Time
+	// Sleep waits after a failure, time.Sleep if nil
+	Sleep func(time.Duration)
+}
+
+// NewBruteForceGuard returns a BruteForceGuard recording the failures in store, a
+// MemoryFailureStore if nil
+func NewBruteForceGuard(store FailureStore) *BruteForceGuard {
+	if store == nil {
+		store = NewMemoryFailureStore()
+	}
+	return &BruteForceGuard{
+		store: store,
+	}
+}
+
+func (g *BruteForceGuard) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+func (g *BruteForceGuard) maxFailures() int {
+	if g.MaxFailures == 0 {
+		return 5
+	}
+	return g.MaxFailures
+}
+
+func (g *BruteForceGuard) lockoutDuration() time.Duration {
+	if g.LockoutDuration == 0 {
+		return 15 * time.Minute
+	}
+	return g.LockoutDuration
+}
+
+// guardKeys returns the keys the failures of identity and address are recorded under. The
+// port of the address is ignored.
+func guardKeys(identity string, address string) []string {
+	keys := []string{"identity:" + identity}
+	if address != "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		keys = append(keys, "address:"+address)
+	}
+	return keys
+}
+
+// attempt runs check, which verifies the credentials of identity, unless identity or
+// address is locked out and records its outcome. A nil guard just runs check.
+func (g *BruteForceGuard) attempt(mechanism string, identity string, address string, check func() error) error {
+	if g == nil {
+		return check()
+	}
+	keys := guardKeys(identity, address)
+	now := g.now()
+	for i, key := range keys {
+		count, last, err := g.store.Failures(key)
+		if err != nil {
+			return &Error{Mechanism: mechanism, Kind: ErrVerifier, Message: "the failures can't be looked up", Err: err}
+		}
+		until := last.Add(g.lockoutDuration())
+		if count > 0 && !now.Before(until) {
+			if err := g.store.Reset(key); err != nil {
+				return &Error{Mechanism: mechanism, Kind: ErrVerifier, Message: "the failures can't be reset", Err: err}
+			}
+		} else if count >= g.maxFailures() {
+			return g.lockout(mechanism, identity, keys, i, until)
+		}
+	}
+
+	// The failure is recorded before the check, otherwise concurrent attempts would all be
+	// checked against the same count
+	failures := 0
+	for i, key := range keys {
+		count, err := g.store.RecordFailure(key, now)
+		if err != nil {
+			g.cancel(keys[:i])
+			return &Error{Mechanism: mechanism, Kind: ErrVerifier, Message: "the failure can't be recorded", Err: err}
+		}
+		if count > g.maxFailures() {
+			// Concurrent attempts took the remaining ones
+			g.cancel(keys[:i+1])
+			return g.lockout(mechanism, identity, keys, i, now.Add(g.lockoutDuration()))
+		}
+		if count > failures {
+			failures = count
+		}
+	}
+
+	err := check()
+	if err == nil {
+		if err := g.store.Reset(keys[0]); err != nil {
+			return &Error{Mechanism: mechanism, Kind: ErrVerifier, Message: "the failures can't be reset", Err: err}
+		}
+		if err := g.cancel(keys[1:]); err != nil {
+			return &Error{Mechanism: mechanism, Kind: ErrVerifier, Message: "the failure can't be cancelled", Err: err}
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrBadCredentials) {
+		g.cancel(keys)
+		return err
+	}
+	g.wait(failures)
+	return err
+}
+
+// lockout returns the error for the locked out keys[i]
+func (g *BruteForceGuard) lockout(mechanism string, identity string, keys []string, i int, until time.Time) error {
+	lockout := &LockoutError{Mechanism: mechanism, Until: until}
+	if i == 0 {
+		lockout.Identity = identity
+	} else {
+		lockout.Address = keys[i][len("address:"):]
+	}
+	return lockout
+}
+
+// cancel takes back the failures recorded for keys, it returns the first error
+func (g *BruteForceGuard) cancel(keys []string) error {
+	var first error
+	for _, key := range keys {
+		if err := g.store.CancelFailure(key); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// wait delays the answer after the given number of consecutive failures
+func (g *BruteForceGuard) wait(failures int) {
+	delay, maxDelay := g.Delay, g.MaxDelay
+	if delay == 0 {
+		delay = 500 * time.Millisecond
+	}
+	if maxDelay == 0 {
+		maxDelay = 8 * time.Second
+	}
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	sleep := g.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	sleep(delay)
+}
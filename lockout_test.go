@@ -0,0 +1,169 @@
+package gosasl
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGuard returns a guard with a fake clock that records the delays instead of waiting
+func testGuard(now *time.Time, delays *[]time.Duration) *BruteForceGuard {
+	guard := NewBruteForceGuard(nil)
+	guard.MaxFailures = 3
+	guard.Now = func() time.Time { return *now }
+	guard.Sleep = func(delay time.Duration) { *delays = append(*delays, delay) }
+	return guard
+}
+
+func plainAttempt(guard *BruteForceGuard, address string, username string, password string) error {
+	mechanism := NewPlainServerMechanism(testVerifier)
+	mechanism.Guard = guard
+	mechanism.RemoteAddress = address
+	_, err := NewSaslServer(mechanism).Start([]byte("\x00" + username + "\x00" + password))
+	return err
+}
+
+func TestBruteForceGuardLockout(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var delays []time.Duration
+	guard := testGuard(&now, &delays)
+
+	for i := 0; i < 3; i++ {
+		if err := plainAttempt(guard, "10.0.0.1:1234", "user", "wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("Expected ErrBadCredentials, got %v", err)
+		}
+	}
+	expected := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+	if len(delays) != len(expected) || delays[0] != expected[0] || delays[1] != expected[1] || delays[2] != expected[2] {
+		t.Fatalf("Expected delays %v, got %v", expected, delays)
+	}
+
+	// Even the right password is refused during the lockout
+	err := plainAttempt(guard, "10.0.0.2:1234", "user", "password")
+	var lockout *LockoutError
+	if !errors.Is(err, ErrTemporarilyLocked) || errors.Is(err, ErrBadCredentials) || !errors.As(err, &lockout) {
+		t.Fatalf("Expected a LockoutError, got %v", err)
+	}
+	if lockout.Identity != "user" || !lockout.Until.Equal(now.Add(15*time.Minute)) {
+		t.Fatalf("Unexpected lockout %+v", lockout)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if err := plainAttempt(guard, "10.0.0.2:1234", "user", "password"); err != nil {
+		t.Fatalf("The lockout should be over: %v", err)
+	}
+	delays = nil
+	if err := plainAttempt(guard, "10.0.0.2:1234", "user", "wrong"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrBadCredentials, got %v", err)
+	}
+	if len(delays) != 1 || delays[0] != 500*time.Millisecond {
+		t.Fatalf("The failures should have been reset, got delays %v", delays)
+	}
+}
+
+func TestBruteForceGuardAddress(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var delays []time.Duration
+	guard := testGuard(&now, &delays)
+	guard.MaxDelay = time.Second
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := plainAttempt(guard, "10.0.0.1:1234", username, "wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("Expected ErrBadCredentials, got %v", err)
+		}
+	}
+	if delays[2] != time.Second {
+		t.Fatalf("The delay should be capped, got %v", delays)
+	}
+	err := plainAttempt(guard, "10.0.0.1:4321", "user", "password")
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) || lockout.Address != "10.0.0.1" {
+		t.Fatalf("Expected the address to be locked, got %v", err)
+	}
+	if err := plainAttempt(guard, "10.0.0.2:1234", "user", "password"); err != nil {
+		t.Fatalf("Other addresses shouldn't be locked: %v", err)
+	}
+}
+
+func TestBruteForceGuardChallengeResponse(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var delays []time.Duration
+	guard := testGuard(&now, &delays)
+	guard.MaxFailures = 1
+
+	mechanism := NewCramMD5ServerMechanism("localhost", testSecrets)
+	mechanism.Guard = guard
+	server := NewSaslServer(mechanism)
+	server.Start(nil)
+	if _, err := server.Step([]byte("user 00000000000000000000000000000000")); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrBadCredentials, got %v", err)
+	}
+
+	client, server, digest := digestMD5Pair("user", "pass")
+	digest.Guard = guard
+	if err := negotiate(client, server); !errors.Is(err, ErrTemporarilyLocked) {
+		t.Fatalf("Expected ErrTemporarilyLocked, got %v", err)
+	}
+	if len(delays) != 1 {
+		t.Fatalf("Expected one delay, got %v", delays)
+	}
+}
+
+func TestBruteForceGuardConcurrentAttempts(t *testing.T) {
+	guard := NewBruteForceGuard(nil)
+	guard.MaxFailures = 3
+	guard.Sleep = func(time.Duration) {}
+	var mutex sync.Mutex
+	checks := 0
+	verifier := VerifierFunc(func(username string, password string) (bool, error) {
+		mutex.Lock()
+		checks++
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return false, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mechanism := NewPlainServerMechanism(verifier)
+			mechanism.Guard = guard
+			NewSaslServer(mechanism).Start([]byte("\x00user\x00wrong"))
+		}()
+	}
+	wg.Wait()
+	if checks > 3 {
+		t.Fatalf("Expected at most 3 checked attempts, got %d", checks)
+	}
+	if count, _, _ := guard.store.Failures("identity:user"); count != 3 {
+		t.Fatalf("Expected 3 failures, got %d", count)
+	}
+}
+
+func TestBruteForceGuardStoreErrors(t *testing.T) {
+	guard := NewBruteForceGuard(failingStore{})
+	if err := plainAttempt(guard, "", "user", "password"); !errors.Is(err, ErrVerifier) {
+		t.Fatalf("A failing store should fail closed, got %v", err)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Failures(key string) (int, time.Time, error) {
+	return 0, time.Time{}, errors.New("unavailable")
+}
+
+func (failingStore) RecordFailure(key string, at time.Time) (int, error) {
+	return 0, errors.New("unavailable")
+}
+
+func (failingStore) CancelFailure(key string) error {
+	return errors.New("unavailable")
+}
+
+func (failingStore) Reset(key string) error {
+	return errors.New("unavailable")
+}
@@ -0,0 +1,205 @@
+package gosasl
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LoginMechanism corresponds to the non-standard LOGIN SASL mechanism, still the only one
+// offered by some SMTP servers. The server prompts for the username and then the password,
+// which are sent in the clear.
+type LoginMechanism struct {
+	*PlainMechanism
+	passcode     string
+	sentUsername bool
+}
+
+// NewLoginMechanism returns a new LoginMechanism
+func NewLoginMechanism(username string, password string) *LoginMechanism {
+	plain := NewPlainMechanism(username, password)
+	config := newDefaultConfig("LOGIN")
+	config.score = 1
+	config.allowsAnonymous = false
+	plain.mechanismConfig = config
+	return &LoginMechanism{
+		PlainMechanism: plain,
+	}
+}
+
+// Start doesn't produce anything, the server speaks first
+func (m *LoginMechanism) Start() ([]byte, error) {
+	return nil, nil
+}
+
+// Step answers a prompt of the server. The prompts are usually "Username:" and "Password:"
+// but servers word them differently, so a prompt that mentions neither gets the username
+// first and the password then. Servers using one-time passcodes instead of passwords prompt
+// for them, e.g. "Passcode:", those are asked to the callback handler with
+// CallbackPasscode.
+func (m *LoginMechanism) Step(challenge []byte) ([]byte, error) {
+	if m.mechanismConfig.complete {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected prompt %q after the password", challenge)
+	}
+	if m.mechanismConfig.AuthorizationID != "" {
+		return nil, newError(m.mechanismConfig.name, ErrInvalidOption, "LOGIN can't carry an authorization id")
+	}
+	prompt := strings.ToLower(string(challenge))
+	if isPasscodePrompt(prompt) {
+		return m.answerPasscode(string(challenge))
+	}
+	if err := m.resolveCredentials(); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(prompt, "pass"):
+	case strings.Contains(prompt, "user") || strings.Contains(prompt, "name") || !m.sentUsername:
+		m.sentUsername = true
+		return []byte(m.username), nil
+	}
+	m.mechanismConfig.complete = true
+	m.mechanismConfig.identity = m.username
+	return []byte(m.password), nil
+}
+
+// resolveCredentials asks the callback handler for the username and the password that
+// weren't given. Unlike PLAIN, LOGIN has no authorization id to ask for.
+func (m *LoginMechanism) resolveCredentials() error {
+	pending := &pendingCallbacks{}
+	pending.add(&m.username, &Callback{ID: CallbackUsername, Prompt: "Username"})
+	pending.add(&m.password, &Callback{ID: CallbackPassword, Prompt: "Password"})
+	if err := m.mechanismConfig.interact(pending); err != nil {
+		return err
+	}
+	if m.username == "" {
+		return newError(m.mechanismConfig.name, ErrMissingCredentials, "no username was provided")
+	}
+	return nil
+}
+
+// passcodePhrases are the words a prompt for a one-time passcode contains, e.g. "Enter
+// PASSCODE:" or "One-time password:"
+var passcodePhrases = [][]string{
+	{"passcode"},
+	{"otp"},
+	{"one", "time"},
+	{"verification", "code"},
+	{"token", "code"},
+}
+
+// isPasscodePrompt returns true if the lowercase prompt asks for a one-time passcode. Only
+// whole words are matched, so that e.g. "Password (token auth)" stays a password prompt.
+func isPasscodePrompt(prompt string) bool {
+	words := strings.FieldsFunc(prompt, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i := range words {
+		for _, phrase := range passcodePhrases {
+			if i+len(phrase) > len(words) {
+				continue
+			}
+			matched := true
+			for j, word := range phrase {
+				matched = matched && words[i+j] == word
+			}
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerPasscode asks the callback handler for a one-time passcode, it takes the place of
+// the password
+func (m *LoginMechanism) answerPasscode(prompt string) ([]byte, error) {
+	if m.username == "" {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the server asked for a passcode before the username")
+	}
+	pending := &pendingCallbacks{}
+	pending.add(&m.passcode, &Callback{ID: CallbackPasscode, Prompt: prompt})
+	if err := m.mechanismConfig.interact(pending); err != nil {
+		return nil, err
+	}
+	if m.passcode == "" {
+		return nil, newError(m.mechanismConfig.name, ErrMissingCredentials, "no passcode was provided")
+	}
+	m.mechanismConfig.complete = true
+	m.mechanismConfig.identity = m.username
+	return []byte(m.passcode), nil
+}
+
+func (m *LoginMechanism) Dispose() {
+	m.password = ""
+	m.passcode = ""
+}
+
+// LoginServerMechanism is the server side of the LOGIN SASL mechanism, it checks the
+// passwords with the same Verifier as PLAIN
+type LoginServerMechanism struct {
+	mechanismConfig *MechanismConfig
+	verifier        Verifier
+	username        string
+	// MaxFieldLength is the max length in bytes of the username and the password
+	MaxFieldLength int
+	// Guard limits the failed attempts, see BruteForceGuard
+	Guard *BruteForceGuard
+	// RemoteAddress is the address of the client, see BruteForceGuard
+	RemoteAddress string
+}
+
+// NewLoginServerMechanism returns a new LoginServerMechanism that checks passwords with the
+// verifier
+func NewLoginServerMechanism(verifier Verifier) *LoginServerMechanism {
+	config := newDefaultConfig("LOGIN")
+	config.score = 1
+	config.allowsAnonymous = false
+	return &LoginServerMechanism{
+		mechanismConfig: config,
+		verifier:        verifier,
+		MaxFieldLength:  PLAIN_MAX_FIELD_LENGTH,
+	}
+}
+
+// Start prompts for the username. Some clients send it as the initial response, they are
+// prompted for the password right away.
+func (m *LoginServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		return []byte("Username:"), nil
+	}
+	return m.Step(initialResponse)
+}
+
+// Step records the username and prompts for the password, then verifies it
+func (m *LoginServerMechanism) Step(response []byte) ([]byte, error) {
+	if !utf8.Valid(response) || len(response) == 0 || len(response) > m.MaxFieldLength {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the response should be non-empty UTF-8 of at most %d bytes", m.MaxFieldLength)
+	}
+	if m.username == "" {
+		m.username = string(response)
+		return []byte("Password:"), nil
+	}
+	err := m.Guard.attempt(m.mechanismConfig.name, m.username, m.RemoteAddress, func() error {
+		return verify(m.mechanismConfig, m.verifier, m.username, string(response))
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.mechanismConfig.identity = m.username
+	m.mechanismConfig.complete = true
+	return nil, nil
+}
+
+func (m *LoginServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *LoginServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *LoginServerMechanism) Dispose() {}
+
+func (m *LoginServerMechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
+}
@@ -0,0 +1,127 @@
+package gosasl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoginMechanism(t *testing.T) {
+	cases := []struct {
+		prompts  []string
+		expected []string
+	}{
+		{[]string{"Username:", "Password:"}, []string{"user", "password"}},
+		{[]string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"}, []string{"user", "password"}},
+		{[]string{"", ""}, []string{"user", "password"}},
+		{[]string{"User Name", "Password"}, []string{"user", "password"}},
+		{[]string{"Password:"}, []string{"password"}},
+		{[]string{"Username:", "Password (token auth):"}, []string{"user", "password"}},
+	}
+	for _, c := range cases {
+		client := NewSaslClient("localhost", NewLoginMechanism("user", "password"))
+		if response, err := client.Start(); err != nil || response != nil {
+			t.Fatalf("LOGIN has no initial response, got %q: %v", response, err)
+		}
+		for i, prompt := range c.prompts {
+			response, err := client.Step([]byte(prompt))
+			if err != nil || string(response) != c.expected[i] {
+				t.Fatalf("%q: expected %q, got %q: %v", prompt, c.expected[i], response, err)
+			}
+		}
+		if !client.Complete() {
+			t.Fatalf("%v: the client should be complete", c.prompts)
+		}
+	}
+}
+
+func TestLoginMechanismPasscode(t *testing.T) {
+	var asked []*Callback
+	handler := CallbackHandlerFunc(func(callbacks []*Callback) error {
+		for _, callback := range callbacks {
+			asked = append(asked, callback)
+			if callback.ID == CallbackPasscode {
+				callback.Result = "123456"
+			}
+		}
+		return nil
+	})
+	client, err := NewSaslClientWithOptions("localhost", NewLoginMechanism("user", ""), WithCallbackHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	if response, err := client.Step([]byte("Username:")); err != nil || string(response) != "user" {
+		t.Fatalf("Expected the username, got %q: %v", response, err)
+	}
+	asked = nil
+	response, err := client.Step([]byte("Enter PASSCODE:"))
+	if err != nil || string(response) != "123456" || !client.Complete() {
+		t.Fatalf("Expected the passcode, got %q: %v", response, err)
+	}
+	if len(asked) != 1 || asked[0].ID != CallbackPasscode || asked[0].Prompt != "Enter PASSCODE:" {
+		t.Fatalf("Only the passcode should have been asked, got %v", asked)
+	}
+
+	client = NewSaslClient("localhost", NewLoginMechanism("user", "password"))
+	client.Start()
+	client.Step([]byte("Username:"))
+	if _, err := client.Step([]byte("One-time password:")); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("Expected ErrMissingCredentials, got %v", err)
+	}
+}
+
+func TestLoginMechanismAuthorizationID(t *testing.T) {
+	var asked []*Callback
+	handler := CallbackHandlerFunc(func(callbacks []*Callback) error {
+		asked = append(asked, callbacks...)
+		for _, callback := range callbacks {
+			callback.Result = "password"
+		}
+		return nil
+	})
+	client, err := NewSaslClientWithOptions("localhost", NewLoginMechanism("user", ""), WithCallbackHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	client.Step([]byte("Username:"))
+	if len(asked) != 1 || asked[0].ID != CallbackPassword {
+		t.Fatalf("Only the password should have been asked, got %v", asked)
+	}
+
+	if _, err := NewSaslClientWithOptions("localhost", NewLoginMechanism("user", "password"), WithAuthorizationID("admin")); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+	if _, err := NewMechanism("LOGIN", Credentials{Username: "user", Password: "password", AuthorizationID: "admin"}); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestLoginServerMechanism(t *testing.T) {
+	server := NewSaslServer(NewLoginServerMechanism(testVerifier))
+	if err := negotiate(NewSaslClient("localhost", NewLoginMechanism("user", "password")), server); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "user" {
+		t.Fatalf("Unexpected identity %q", server.AuthenticatedIdentity())
+	}
+
+	// The username sent as the initial response
+	server = NewSaslServer(NewLoginServerMechanism(testVerifier))
+	challenge, err := server.Start([]byte("user"))
+	if err != nil || string(challenge) != "Password:" {
+		t.Fatalf("Expected the password prompt, got %q: %v", challenge, err)
+	}
+	if _, err := server.Step([]byte("wrong")); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrBadCredentials, got %v", err)
+	}
+
+	server = NewSaslServer(NewLoginServerMechanism(testVerifier))
+	server.Start(nil)
+	if _, err := server.Step([]byte{}); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+	if err := offerable(NewLoginServerMechanism(testVerifier).Config(), ConnectionInfo{}); !errors.Is(err, ErrSecurityPolicy) {
+		t.Fatalf("LOGIN shouldn't be offered without TLS, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package gosasl
+
+// reverseMechanism is a Mechanism implemented as outside this package would, it answers
+// with the challenge reversed. It is shared by the tests of both builds.
+type reverseMechanism struct {
+	config *MechanismConfig
+}
+
+func (m *reverseMechanism) Start() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *reverseMechanism) Step(challenge []byte) ([]byte, error) {
+	m.config.SetComplete(true)
+	response := make([]byte, len(challenge))
+	for i, b := range challenge {
+		response[len(challenge)-1-i] = b
+	}
+	return response, nil
+}
+
+func (m *reverseMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *reverseMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *reverseMechanism) Dispose() {}
+
+func (m *reverseMechanism) Config() *MechanismConfig {
+	return m.config
+}
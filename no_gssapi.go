@@ -4,41 +4,85 @@ package gosasl
 
 // GSSAPIMechanism corresponds to GSSAPI SASL mechanism
 type GSSAPIMechanism struct {
-	host string
+	config        *MechanismConfig
+	host          string
+	UserSelectQop uint8
+	MaxLength     int
+	ServiceHost   string
 }
 
 const errorMsg string = "gosasl may have been installed without kerberos support please reinstall with `go get` using the flags `build kerberos`. Alternatively if `go run` is being ran it should be ran with `go run -tags kerberos ...` and the binary should have been build with `go build -tags kerberos ...`."
 
-// NewGSSAPIMechanism returns a new GSSAPIMechanism
+func errNoKerberos() error {
+	return newError("GSSAPI", ErrUnsupportedMechanism, errorMsg)
+}
+
+// NewGSSAPIMechanism returns an ErrUnsupportedMechanism error, gosasl was built without kerberos support
 func NewGSSAPIMechanism(service string) (mechanism *GSSAPIMechanism, err error) {
-	panic(errorMsg)
+	return nil, errNoKerberos()
+}
+
+func (m *GSSAPIMechanism) Start() ([]byte, error) {
+	return nil, errNoKerberos()
+}
+
+func (m *GSSAPIMechanism) Step(challenge []byte) ([]byte, error) {
+	return nil, errNoKerberos()
+}
+
+func (m *GSSAPIMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m *GSSAPIMechanism) start() ([]byte, error) {
-	panic(errorMsg)
-	return nil, nil
+func (m *GSSAPIMechanism) Decode(incoming []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m *GSSAPIMechanism) step(challenge []byte) ([]byte, error) {
-	panic(errorMsg)
-	return nil, nil
+func (m *GSSAPIMechanism) Dispose() {}
+
+// Config returns the same configuration on every call, so that options applied to the
+// stub aren't lost
+func (m *GSSAPIMechanism) Config() *MechanismConfig {
+	if m.config == nil {
+		m.config = newDefaultConfig("GSSAPI")
+	}
+	return m.config
+}
+
+// GSSAPIServerMechanism corresponds to the server side of the GSSAPI SASL mechanism
+type GSSAPIServerMechanism struct {
+	config        *MechanismConfig
+	Authorizer    Authorizer
+	UserSelectQop uint8
+	MaxLength     int
+}
+
+// NewGSSAPIServerMechanism returns an ErrUnsupportedMechanism error, gosasl was built without kerberos support
+func NewGSSAPIServerMechanism(principal string, keytab string) (*GSSAPIServerMechanism, error) {
+	return nil, errNoKerberos()
+}
+
+func (m *GSSAPIServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m GSSAPIMechanism) encode(outgoing []byte) ([]byte, error) {
-	panic(errorMsg)
-	return nil, nil
+func (m *GSSAPIServerMechanism) Step(response []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m GSSAPIMechanism) decode(incoming []byte) ([]byte, error) {
-	panic(errorMsg)
-	return nil, nil
+func (m *GSSAPIServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m GSSAPIMechanism) dispose() {
-	panic(errorMsg)
+func (m *GSSAPIServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return nil, errNoKerberos()
 }
 
-func (m GSSAPIMechanism) getConfig() *MechanismConfig {
-	panic(errorMsg)
-	return nil
+func (m *GSSAPIServerMechanism) Dispose() {}
+
+func (m *GSSAPIServerMechanism) Config() *MechanismConfig {
+	if m.config == nil {
+		m.config = newDefaultConfig("GSSAPI")
+	}
+	return m.config
 }
@@ -0,0 +1,139 @@
+package gosasl
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// OAuthBearerServerMechanism is the server side of the OAUTHBEARER SASL mechanism, see
+// RFC 7628. The client presents a bearer token that is checked by a TokenValidator.
+type OAuthBearerServerMechanism struct {
+	config    *MechanismConfig
+	validator TokenValidator
+	// failure is the reason of the rejection once the error challenge has been sent
+	failure error
+	// Host and Port are the fields sent by the client, if any
+	Host string
+	Port string
+	// Scope is the scope advertised to the client when its token is rejected
+	Scope string
+	// OpenIDConfiguration is the URL of the OpenID Connect discovery document advertised
+	// to the client when its token is rejected
+	OpenIDConfiguration string
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+}
+
+// NewOAuthBearerServerMechanism returns a new OAuthBearerServerMechanism checking the
+// tokens with validator, e.g. a JWTValidator
+func NewOAuthBearerServerMechanism(validator TokenValidator) *OAuthBearerServerMechanism {
+	config := newDefaultConfig("OAUTHBEARER")
+	config.allowsAnonymous = false
+	return &OAuthBearerServerMechanism{
+		config:    config,
+		validator: validator,
+	}
+}
+
+// oauthBearerError is the error challenge sent to the client, RFC 7628 section 3.2.2
+type oauthBearerError struct {
+	Status              string `json:"status"`
+	Scope               string `json:"scope,omitempty"`
+	OpenIDConfiguration string `json:"openid-configuration,omitempty"`
+}
+
+// Start processes the initial client response, clients that don't send one get an empty
+// challenge
+func (m *OAuthBearerServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+// Step validates the token of the client. A rejected token is answered with the error
+// challenge, the authentication fails once the client acknowledges it.
+func (m *OAuthBearerServerMechanism) Step(response []byte) ([]byte, error) {
+	if m.failure != nil {
+		if string(response) != "\x01" {
+			return nil, newError(m.config.name, ErrProtocol, "the error challenge should be acknowledged with a lone separator")
+		}
+		return nil, m.failure
+	}
+	if !utf8.Valid(response) {
+		return nil, newError(m.config.name, ErrProtocol, "the response isn't valid UTF-8")
+	}
+	header, rest, err := parseGS2Header(m.config.name, string(response))
+	if err != nil {
+		return nil, err
+	}
+	if header.cbindFlag == "p" {
+		return nil, newError(m.config.name, ErrProtocol, "channel binding isn't supported")
+	}
+	token, err := m.parseFields(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := m.validator.ValidateToken(token)
+	if err != nil {
+		m.failure = &Error{Mechanism: m.config.name, Kind: ErrBadCredentials, Message: "the token was rejected", Err: err}
+		return json.Marshal(oauthBearerError{
+			Status:              "invalid_token",
+			Scope:               m.Scope,
+			OpenIDConfiguration: m.OpenIDConfiguration,
+		})
+	}
+	if err := authorize(m.config, m.Authorizer, subject, header.authorizationID); err != nil {
+		return nil, err
+	}
+	m.config.complete = true
+	return nil, nil
+}
+
+// parseFields reads the key-value pairs that follow the GS2 header and returns the
+// bearer token
+func (m *OAuthBearerServerMechanism) parseFields(fields string) (string, error) {
+	if !strings.HasPrefix(fields, "\x01") || !strings.HasSuffix(fields, "\x01\x01") || len(fields) < 3 {
+		return "", newError(m.config.name, ErrProtocol, "the key-value pairs aren't properly separated")
+	}
+	var token string
+	for _, field := range strings.Split(fields[1:len(fields)-2], "\x01") {
+		equal := strings.IndexByte(field, '=')
+		if equal <= 0 {
+			return "", newError(m.config.name, ErrProtocol, "invalid key-value pair %q", field)
+		}
+		key, value := field[:equal], field[equal+1:]
+		switch key {
+		case "auth":
+			space := strings.IndexByte(value, ' ')
+			if space < 0 || !strings.EqualFold(value[:space], "Bearer") {
+				return "", newError(m.config.name, ErrProtocol, "only bearer tokens are supported")
+			}
+			token = strings.TrimLeft(value[space:], " ")
+		case "host":
+			m.Host = value
+		case "port":
+			m.Port = value
+		}
+	}
+	if token == "" {
+		return "", newError(m.config.name, ErrProtocol, "the client didn't send a token")
+	}
+	return token, nil
+}
+
+func (m *OAuthBearerServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *OAuthBearerServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *OAuthBearerServerMechanism) Dispose() {}
+
+func (m *OAuthBearerServerMechanism) Config() *MechanismConfig {
+	return m.config
+}
@@ -0,0 +1,269 @@
+package gosasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1600000000, 0)
+
+// signJWT builds a token with the given claims signed by key, a []byte, *rsa.PrivateKey or
+// *ecdsa.PrivateKey
+func signJWT(t *testing.T, key interface{}, kid string, claims map[string]interface{}) string {
+	header := map[string]string{"typ": "JWT", "kid": kid}
+	switch key.(type) {
+	case []byte:
+		header["alg"] = "HS256"
+	case *rsa.PrivateKey:
+		header["alg"] = "RS256"
+	case *ecdsa.PrivateKey:
+		header["alg"] = "ES256"
+	}
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(input))
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://issuer.example.com",
+		"aud": []string{"kafka", "other"},
+		"exp": testNow.Add(time.Hour).Unix(),
+		"nbf": testNow.Add(-time.Hour).Unix(),
+	}
+}
+
+func oauthBearerResponse(authorizationID string, token string) []byte {
+	header := "n,,"
+	if authorizationID != "" {
+		header = "n,a=" + authorizationID + ","
+	}
+	return []byte(header + "\x01host=server.example.com\x01port=9092\x01auth=Bearer " + token + "\x01\x01")
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := NewJWTValidator(map[string]interface{}{
+		"hmac": []byte("secret"),
+		"rsa":  &rsaKey.PublicKey,
+		"ec":   &ecKey.PublicKey,
+	})
+	validator.Issuer = "https://issuer.example.com"
+	validator.Audience = "kafka"
+	validator.Now = func() time.Time { return testNow }
+
+	for kid, key := range map[string]interface{}{"hmac": []byte("secret"), "rsa": rsaKey, "ec": ecKey} {
+		subject, err := validator.ValidateToken(signJWT(t, key, kid, testClaims()))
+		if err != nil || subject != "alice" {
+			t.Fatalf("%s: expected alice, got %q: %v", kid, subject, err)
+		}
+	}
+
+	invalid := map[string]func(map[string]interface{}){
+		"expired":    func(claims map[string]interface{}) { claims["exp"] = testNow.Add(-time.Minute).Unix() },
+		"no exp":     func(claims map[string]interface{}) { delete(claims, "exp") },
+		"not yet":    func(claims map[string]interface{}) { claims["nbf"] = testNow.Add(time.Minute).Unix() },
+		"issuer":     func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+		"audience":   func(claims map[string]interface{}) { claims["aud"] = "zookeeper" },
+		"no subject": func(claims map[string]interface{}) { delete(claims, "sub") },
+	}
+	for name, tamper := range invalid {
+		claims := testClaims()
+		tamper(claims)
+		if _, err := validator.ValidateToken(signJWT(t, rsaKey, "rsa", claims)); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("%s: expected ErrBadCredentials, got %v", name, err)
+		}
+	}
+	claims := testClaims()
+	claims["aud"] = "kafka"
+	if _, err := validator.ValidateToken(signJWT(t, rsaKey, "rsa", claims)); err != nil {
+		t.Fatalf("A string audience should be accepted: %v", err)
+	}
+
+	// The key must match the algorithm and the signer
+	if _, err := validator.ValidateToken(signJWT(t, []byte("secret"), "rsa", testClaims())); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("HS256 with an RSA key should be rejected, got %v", err)
+	}
+	if _, err := validator.ValidateToken(signJWT(t, []byte("wrong"), "hmac", testClaims())); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("A wrong signature should be rejected, got %v", err)
+	}
+	if _, err := validator.ValidateToken(signJWT(t, ecKey, "unknown", testClaims())); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("An unknown key should be rejected, got %v", err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"hmac"}`)) + ".e30."
+	if _, err := validator.ValidateToken(unsigned); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Unsigned tokens should be rejected, got %v", err)
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(value *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(value.Bytes())
+	}
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "RSA", "kid": "rsa", "n": %q, "e": %q},
+		{"kty": "oct", "kid": "hmac", "k": %q},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "", "e": ""}
+	]}`, encode(ecKey.X), encode(ecKey.Y), encode(rsaKey.N), encode(big.NewInt(int64(rsaKey.E))),
+		base64.RawURLEncoding.EncodeToString([]byte("secret")))
+	file, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(jwks); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	keys, err := LoadJWKS(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 signature keys, got %d", len(keys))
+	}
+	validator := NewJWTValidator(keys)
+	validator.Now = func() time.Time { return testNow }
+	for kid, key := range map[string]interface{}{"hmac": []byte("secret"), "rsa": rsaKey, "ec": ecKey} {
+		if _, err := validator.ValidateToken(signJWT(t, key, kid, testClaims())); err != nil {
+			t.Fatalf("%s: %v", kid, err)
+		}
+	}
+
+	if _, err := ParseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`)); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("A point off the curve should be rejected, got %v", err)
+	}
+}
+
+func TestOAuthBearerServerMechanism(t *testing.T) {
+	validator := NewJWTValidator(map[string]interface{}{"": []byte("secret")})
+	validator.Now = func() time.Time { return testNow }
+	token := signJWT(t, []byte("secret"), "", testClaims())
+
+	mechanism := NewOAuthBearerServerMechanism(validator)
+	server := NewSaslServer(mechanism)
+	if _, err := server.Start(oauthBearerResponse("", token)); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Complete() || server.AuthenticatedIdentity() != "alice" || server.AuthorizationID() != "alice" {
+		t.Fatalf("Unexpected outcome: complete %v, identity %q", server.Complete(), server.AuthenticatedIdentity())
+	}
+	if mechanism.Host != "server.example.com" || mechanism.Port != "9092" {
+		t.Fatalf("Unexpected host %q and port %q", mechanism.Host, mechanism.Port)
+	}
+
+	server = NewSaslServer(NewOAuthBearerServerMechanism(validator))
+	if _, err := server.Start(oauthBearerResponse("admin", token)); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Acting as someone else should be denied by default, got %v", err)
+	}
+	server = NewSaslServer(NewOAuthBearerServerMechanism(validator))
+	if _, err := server.Start(oauthBearerResponse("alice", token)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOAuthBearerServerMechanismErrorChallenge(t *testing.T) {
+	validator := TokenValidatorFunc(func(token string) (string, error) {
+		return "", errors.New("expired")
+	})
+	mechanism := NewOAuthBearerServerMechanism(validator)
+	mechanism.Scope = "kafka"
+	mechanism.OpenIDConfiguration = "https://issuer.example.com/.well-known/openid-configuration"
+	server := NewSaslServer(mechanism)
+	challenge, err := server.Start(oauthBearerResponse("", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"status":"invalid_token","scope":"kafka","openid-configuration":"https://issuer.example.com/.well-known/openid-configuration"}`
+	if string(challenge) != expected {
+		t.Fatalf("Expected %s, got %s", expected, challenge)
+	}
+	if _, err := server.Step([]byte("\x01")); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrBadCredentials, got %v", err)
+	}
+	if server.State() != StateFailed {
+		t.Fatalf("Expected %s, got %s", StateFailed, server.State())
+	}
+}
+
+func TestOAuthBearerServerMechanismErrors(t *testing.T) {
+	validator := TokenValidatorFunc(func(token string) (string, error) {
+		return "alice", nil
+	})
+	cases := []string{
+		"n,,auth=Bearer token\x01\x01",
+		"n,,\x01auth=Bearer token\x01",
+		"n,,\x01auth=Basic dXNlcjpwYXNz\x01\x01",
+		"n,,\x01host=server\x01\x01",
+		"p=tls-unique,,\x01auth=Bearer token\x01\x01",
+		"x,,\x01auth=Bearer token\x01\x01",
+		"n,a=a=b,\x01auth=Bearer token\x01\x01",
+		"n\x01auth=Bearer token\x01\x01",
+	}
+	for _, response := range cases {
+		server := NewSaslServer(NewOAuthBearerServerMechanism(validator))
+		if _, err := server.Start([]byte(response)); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("%q: expected ErrProtocol, got %v", response, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package gosasl
+
+import (
+	"io"
+	"strings"
+)
+
+// Logger is the interface used to log messages, *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option configures a Client and the mechanism it runs, see NewSaslClient. Options are
+// validated when the client is built so that misconfigurations surface before the
+// handshake.
+type Option func(client *Client) error
+
+// NewSaslClientWithOptions is NewSaslClient returning the error of the first invalid
+// option instead of deferring it to Start
+func NewSaslClientWithOptions(host string, mechanism Mechanism, opts ...Option) (*Client, error) {
+	client := NewSaslClient(host, mechanism, opts...)
+	if client.err != nil {
+		return nil, client.err
+	}
+	return client, nil
+}
+
+func invalidOption(client *Client, format string, args ...interface{}) error {
+	return newError(client.mechanism.Config().name, ErrInvalidOption, format, args...)
+}
+
+// WithAuthorizationID sets the identity to act as, see MechanismConfig.AuthorizationID
+func WithAuthorizationID(authorizationID string) Option {
+	return func(client *Client) error {
+		if strings.ContainsRune(authorizationID, 0) {
+			return invalidOption(client, "the authorization id can't contain NUL")
+		}
+		if _, ok := client.mechanism.(*LoginMechanism); ok && authorizationID != "" {
+			return invalidOption(client, "LOGIN can't carry an authorization id")
+		}
+		client.mechanism.Config().AuthorizationID = authorizationID
+		return nil
+	}
+}
+
+// WithQOP restricts the QOP values that can be negotiated, e.g. WithQOP(AUTH_INT, AUTH_CONF)
+func WithQOP(qops ...string) Option {
+	return func(client *Client) error {
+		var flags uint8
+		for _, qop := range qops {
+			flag, ok := QOP_TO_FLAG[qop]
+			if !ok {
+				return invalidOption(client, "unknown qop %q", qop)
+			}
+			flags |= flag
+		}
+		if flags&client.mechanism.Config().supportedQop() == 0 {
+			return invalidOption(client, "none of the qop %v is supported", qops)
+		}
+		switch mechanism := client.mechanism.(type) {
+		case *GSSAPIMechanism:
+			mechanism.UserSelectQop = flags
+		case *DigestMD5Mechanism:
+			mechanism.UserSelectQop = flags
+		default:
+			return invalidOption(client, "the mechanism has no security layer")
+		}
+		return nil
+	}
+}
+
+// WithMaxBuffer sets the max buffer size the client accepts on the security layer
+func WithMaxBuffer(size int) Option {
+	return func(client *Client) error {
+		if size <= 0 || size > 0xFFFFFF {
+			return invalidOption(client, "the max buffer size %d doesn't fit in 3 bytes", size)
+		}
+		mechanism, ok := client.mechanism.(*GSSAPIMechanism)
+		if !ok {
+			return invalidOption(client, "the mechanism has no security layer")
+		}
+		mechanism.MaxLength = size
+		return nil
+	}
+}
+
+// WithRandom sets the source of randomness used for nonces, crypto/rand by default
+func WithRandom(random io.Reader) Option {
+	return func(client *Client) error {
+		if random == nil {
+			return invalidOption(client, "the random source is nil")
+		}
+		client.mechanism.Config().randomSource = random
+		return nil
+	}
+}
+
+// WithLogger sets the logger used by the mechanism, the standard logger by default
+func WithLogger(logger Logger) Option {
+	return func(client *Client) error {
+		if logger == nil {
+			return invalidOption(client, "the logger is nil")
+		}
+		client.mechanism.Config().logger = logger
+		return nil
+	}
+}
+
+// WithSecurityPolicy restricts the client to the given policy, see Client.SetSecurityPolicy
+func WithSecurityPolicy(policy SecurityPolicy) Option {
+	return func(client *Client) error {
+		return client.SetSecurityPolicy(policy)
+	}
+}
+
+// WithServiceHost sets the host of the GSSAPI service principal when it differs from the
+// host the client connects to. It replaces the SERVICE_HOST_QUALIFIED environment variable.
+func WithServiceHost(host string) Option {
+	return func(client *Client) error {
+		mechanism, ok := client.mechanism.(*GSSAPIMechanism)
+		if !ok {
+			return invalidOption(client, "a service host only applies to GSSAPI")
+		}
+		if host == "" || strings.Contains(host, "/") {
+			return invalidOption(client, "invalid service host %q", host)
+		}
+		mechanism.ServiceHost = host
+		return nil
+	}
+}
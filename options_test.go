@@ -0,0 +1,88 @@
+package gosasl
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClientOptions(t *testing.T) {
+	client, err := NewSaslClientWithOptions("localhost", NewPlainMechanism("user", "password"), WithAuthorizationID("authId"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetConfig().AuthorizationID != "authId" {
+		t.Fatal("WithAuthorizationID should set the authorization id")
+	}
+
+	mechanism := NewDigestMD5Mechanism("imap", "chris", "secret")
+	client, err = NewSaslClientWithOptions("elwood.innosoft.com", mechanism, WithQOP(AUTH), WithRandom(bytes.NewReader(make([]byte, 14))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mechanism.UserSelectQop != QOP_TO_FLAG[AUTH] {
+		t.Fatalf("WithQOP should set UserSelectQop, got %d", mechanism.UserSelectQop)
+	}
+	client.Start()
+	response, err := client.Step([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response), `cnonce="aaaaaaaaaaaaaa"`) {
+		t.Fatalf("The cnonce should come from the random source: %s", response)
+	}
+}
+
+func TestInvalidClientOptions(t *testing.T) {
+	cases := map[string][]Option{
+		"NUL authorization id": {WithAuthorizationID("auth\x00Id")},
+		"unknown qop":          {WithQOP("auth-everything")},
+		"unsupported qop":      {WithQOP(AUTH_CONF)},
+		"no security layer":    {WithMaxBuffer(1024)},
+		"nil random":           {WithRandom(nil)},
+		"nil logger":           {WithLogger(nil)},
+		"not GSSAPI":           {WithServiceHost("host")},
+		"policy":               {WithSecurityPolicy(SecurityPolicy{MinSSF: 56})},
+	}
+	for name, opts := range cases {
+		_, err := NewSaslClientWithOptions("localhost", NewDigestMD5Mechanism("imap", "user", "password"), opts...)
+		if err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if name != "policy" && !errors.Is(err, ErrInvalidOption) {
+			t.Fatalf("%s: expected ErrInvalidOption, got %v", name, err)
+		}
+	}
+	if _, err := NewSaslClientWithOptions("localhost", NewPlainMechanism("user", "password"), WithQOP(AUTH)); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("WithQOP on a mechanism without security layer: expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestNewSaslClientOptions(t *testing.T) {
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "password"), WithAuthorizationID("authId"))
+	response, err := client.Start()
+	if err != nil || string(response) != "authId\x00user\x00password" {
+		t.Fatalf("Unexpected response %q: %v", response, err)
+	}
+
+	client = NewSaslClient("localhost", NewPlainMechanism("user", "password"), WithAuthorizationID("auth\x00Id"))
+	if _, err := client.Start(); !errors.Is(err, ErrInvalidOption) || client.State() != StateFailed {
+		t.Fatalf("An invalid option should make Start fail, got %v", err)
+	}
+}
+
+func TestNewSaslClientFromOfferWithOptions(t *testing.T) {
+	credentials := Credentials{Username: "user", Password: "password"}
+	client, err := NewSaslClientFromOffer("localhost", []string{"PLAIN", "ANONYMOUS"}, credentials, WithSecurityPolicy(SecurityPolicy{NoAnonymous: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetConfig().Name() != "PLAIN" {
+		t.Fatalf("Expected PLAIN, got %s", client.GetConfig().Name())
+	}
+	_, err = NewSaslClientFromOffer("localhost", []string{"PLAIN", "ANONYMOUS"}, credentials, WithSecurityPolicy(SecurityPolicy{NoAnonymous: true, NoPlaintext: true}))
+	if !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("Expected ErrUnsupportedMechanism, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package gosasl
+
+import (
+	"strings"
+)
+
+// SecurityPolicy restricts which mechanisms and security layers a Client accepts.
+// It is checked against the security properties of the mechanism before the handshake
+// and against the negotiated QOP once it has completed.
+type SecurityPolicy struct {
+	// NoPlaintext rejects mechanisms that send the password in the clear, e.g. PLAIN
+	NoPlaintext bool
+	// NoAnonymous rejects mechanisms that allow anonymous login, e.g. ANONYMOUS
+	NoAnonymous bool
+	// NoActive rejects mechanisms that are vulnerable to active (non-dictionary) attacks
+	NoActive bool
+	// NoDictionary rejects mechanisms that are vulnerable to passive dictionary attacks
+	NoDictionary bool
+	// MinSSF is the minimum security strength factor of the security layer.
+	// 0 means authentication only, 1 requires integrity protection and anything above
+	// requires confidentiality.
+	MinSSF int
+	// MutualAuth requires the server to authenticate itself to the client
+	MutualAuth bool
+}
+
+// SSF returns the security strength factor provided by the given QOP flag
+func SSF(qop byte) int {
+	switch qop {
+	case QOP_TO_FLAG[AUTH_CONF]:
+		return 56
+	case QOP_TO_FLAG[AUTH_INT]:
+		return 1
+	}
+	return 0
+}
+
+// qopName returns the name of the given QOP flag, e.g. "auth-int"
+func qopName(qop byte) string {
+	for name, flag := range QOP_TO_FLAG {
+		if flag == qop {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseQopList turns a comma separated list of QOP names into flags
+func parseQopList(list string) byte {
+	var flags byte
+	for _, name := range strings.Split(list, ",") {
+		flags |= QOP_TO_FLAG[strings.TrimSpace(name)]
+	}
+	return flags
+}
+
+// allowedQop returns the QOP flags that satisfy MinSSF
+func (p *SecurityPolicy) allowedQop() byte {
+	var flags byte
+	for _, qop := range QOP_TO_FLAG {
+		if p == nil || SSF(qop) >= p.MinSSF {
+			flags |= qop
+		}
+	}
+	return flags
+}
+
+// check verifies that the mechanism can satisfy the policy at all
+func (p *SecurityPolicy) check(config *MechanismConfig) error {
+	switch {
+	case p.NoPlaintext && config.usesPlaintext:
+		return newError(config.name, ErrSecurityPolicy, "the password is sent in the clear")
+	case p.NoAnonymous && config.allowsAnonymous:
+		return newError(config.name, ErrSecurityPolicy, "anonymous login is allowed")
+	case p.NoActive && !config.activeSafe:
+		return newError(config.name, ErrSecurityPolicy, "not safe against active attacks")
+	case p.NoDictionary && !config.dictionarySafe:
+		return newError(config.name, ErrSecurityPolicy, "not safe against dictionary attacks")
+	case p.MutualAuth && !config.mutualAuth:
+		return newError(config.name, ErrSecurityPolicy, "the server is not authenticated")
+	case config.supportedQop()&p.allowedQop() == 0:
+		return newError(config.name, ErrSecurityPolicy, "no security layer with SSF %d", p.MinSSF)
+	}
+	return nil
+}
+
+// checkNegotiated verifies the QOP negotiated during the handshake
+func (p *SecurityPolicy) checkNegotiated(config *MechanismConfig) error {
+	qop := config.negotiatedQop
+	if qop == 0 {
+		qop = QOP_TO_FLAG[AUTH]
+	}
+	if SSF(qop) < p.MinSSF {
+		return newError(config.name, ErrQOPNegotiation, "negotiated qop %s is below the SSF %d required by the security policy", qopName(qop), p.MinSSF)
+	}
+	return nil
+}
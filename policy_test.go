@@ -0,0 +1,66 @@
+package gosasl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecurityPolicyRejectsMechanisms(t *testing.T) {
+	cases := []struct {
+		mechanism Mechanism
+		policy    SecurityPolicy
+		allowed   bool
+	}{
+		{NewPlainMechanism("user", "password"), SecurityPolicy{NoPlaintext: true}, false},
+		{NewCramMD5Mechanism("user", "password"), SecurityPolicy{NoPlaintext: true}, true},
+		{NewAnonymousMechanism(), SecurityPolicy{NoAnonymous: true}, false},
+		{NewPlainMechanism("user", "password"), SecurityPolicy{NoAnonymous: true}, true},
+		{NewDigestMD5Mechanism("imap", "user", "password"), SecurityPolicy{MinSSF: 1}, false},
+		{NewDigestMD5Mechanism("imap", "user", "password"), SecurityPolicy{MutualAuth: true}, true},
+		{NewCramMD5Mechanism("user", "password"), SecurityPolicy{MutualAuth: true}, false},
+		{NewCramMD5Mechanism("user", "password"), SecurityPolicy{NoDictionary: true}, false},
+	}
+	for _, c := range cases {
+		client := NewSaslClient("localhost", c.mechanism)
+		err := client.SetSecurityPolicy(c.policy)
+		if c.allowed && err != nil {
+			t.Fatalf("%s should satisfy %+v: %s", c.mechanism.Config().Name(), c.policy, err)
+		}
+		if !c.allowed && err == nil {
+			t.Fatalf("%s shouldn't satisfy %+v", c.mechanism.Config().Name(), c.policy)
+		}
+	}
+}
+
+func TestDigestMD5SelectsQop(t *testing.T) {
+	mechanism := NewDigestMD5Mechanism("imap", "chris", "secret")
+	client := NewSaslClient("elwood.innosoft.com", mechanism)
+	client.Start()
+	response, err := client.Step([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth,auth-int",algorithm=md5-sess,charset=utf-8`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "qop=auth,") {
+		t.Fatalf("Expected qop=auth to be selected, got %s", response)
+	}
+
+	mechanism = NewDigestMD5Mechanism("imap", "chris", "secret")
+	client = NewSaslClient("elwood.innosoft.com", mechanism)
+	client.Start()
+	if _, err := client.Step([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth-conf"`)); err == nil {
+		t.Fatal("No acceptable qop should fail")
+	}
+}
+
+func TestSecurityPolicyChecksNegotiatedQop(t *testing.T) {
+	mechanism := &reverseMechanism{config: NewMechanismConfig("X-REVERSE")}
+	mechanism.config.qop = QOP{QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT]}
+	client := NewSaslClient("localhost", mechanism)
+	if err := client.SetSecurityPolicy(SecurityPolicy{MinSSF: 1}); err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	if _, err := client.Step([]byte("abcd")); err == nil {
+		t.Fatal("Negotiating auth should fail with a MinSSF of 1")
+	}
+}
@@ -0,0 +1,278 @@
+package gosasl
+
+import (
+	"crypto/tls"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Credentials holds what is needed to build a mechanism by name. Mechanisms only use
+// the fields that apply to them.
+type Credentials struct {
+	// Service is the name of the service to authenticate against, e.g. "imap" or "hive"
+	Service  string
+	Username string
+	Password string
+	// AuthorizationID is the identity to act as, if different from Username
+	AuthorizationID string
+	// Callbacks, if set, is asked for the credentials above that are left empty
+	Callbacks CallbackHandler
+	// TLS is the connection to the server, if any. The mechanisms using channel binding,
+	// e.g. SCRAM-SHA-256-PLUS, need it.
+	TLS *tls.ConnectionState
+	// AllowPasswordless lets NewSaslClientFromOffer pick ANONYMOUS or EXTERNAL even though
+	// a password or callbacks were given. Otherwise they are skipped, so that an offer
+	// stripped of the password mechanisms can't silently downgrade the client.
+	AllowPasswordless bool
+}
+
+// hasPassword returns true if the credentials can provide a password, directly or with
+// the callbacks
+func (credentials Credentials) hasPassword() bool {
+	return credentials.Password != "" || credentials.Callbacks != nil
+}
+
+// passwordless are the built-in mechanisms that don't use the password
+var passwordless = map[string]bool{
+	"ANONYMOUS": true,
+	"EXTERNAL":  true,
+}
+
+// requirePassword checks that the credentials have a username and a password, or the
+// callbacks to ask for them
+func requirePassword(mechanism string, credentials Credentials) error {
+	if credentials.Callbacks == nil && (credentials.Username == "" || credentials.Password == "") {
+		return newError(mechanism, ErrMissingCredentials, "a username and a password are required")
+	}
+	return nil
+}
+
+// MechanismFactory builds a new mechanism from the given credentials. It should return an
+// error if the credentials are not enough for the mechanism to run.
+type MechanismFactory func(credentials Credentials) (Mechanism, error)
+
+// ConnectionInfo describes the connection a Server authenticates a client on
+type ConnectionInfo struct {
+	// TLS is the state of the connection, nil if it isn't encrypted
+	TLS *tls.ConnectionState
+	// RemoteAddress is the address of the client, e.g. for BruteForceGuard
+	RemoteAddress string
+	// Policy further restricts the mechanisms offered, e.g. NoAnonymous
+	Policy SecurityPolicy
+}
+
+// encrypted returns true if the connection is protected by TLS
+func (conn ConnectionInfo) encrypted() bool {
+	return conn.TLS != nil && conn.TLS.HandshakeComplete
+}
+
+// ServerMechanismFactory builds a new server mechanism to authenticate a client on the
+// given connection
+type ServerMechanismFactory func(conn ConnectionInfo) (ServerMechanism, error)
+
+var (
+	registryMu     sync.RWMutex
+	registry       = make(map[string]MechanismFactory)
+	serverRegistry = make(map[string]ServerMechanismFactory)
+)
+
+func init() {
+	RegisterMechanism("ANONYMOUS", func(credentials Credentials) (Mechanism, error) {
+		return NewAnonymousMechanism(), nil
+	})
+	RegisterMechanism("EXTERNAL", func(credentials Credentials) (Mechanism, error) {
+		return NewExternalMechanism(), nil
+	})
+	RegisterMechanism("PLAIN", func(credentials Credentials) (Mechanism, error) {
+		if err := requirePassword("PLAIN", credentials); err != nil {
+			return nil, err
+		}
+		return NewPlainMechanism(credentials.Username, credentials.Password), nil
+	})
+	RegisterMechanism("LOGIN", func(credentials Credentials) (Mechanism, error) {
+		if err := requirePassword("LOGIN", credentials); err != nil {
+			return nil, err
+		}
+		if credentials.AuthorizationID != "" {
+			return nil, newError("LOGIN", ErrInvalidOption, "LOGIN can't carry an authorization id")
+		}
+		return NewLoginMechanism(credentials.Username, credentials.Password), nil
+	})
+	RegisterMechanism("CRAM-MD5", func(credentials Credentials) (Mechanism, error) {
+		if err := requirePassword("CRAM-MD5", credentials); err != nil {
+			return nil, err
+		}
+		return NewCramMD5Mechanism(credentials.Username, credentials.Password), nil
+	})
+	RegisterMechanism("DIGEST-MD5", func(credentials Credentials) (Mechanism, error) {
+		if credentials.Service == "" {
+			return nil, newError("DIGEST-MD5", ErrMissingCredentials, "a service is required")
+		}
+		if err := requirePassword("DIGEST-MD5", credentials); err != nil {
+			return nil, err
+		}
+		return NewDigestMD5Mechanism(credentials.Service, credentials.Username, credentials.Password), nil
+	})
+	for name, newScram := range map[string]func(string, string) *ScramMechanism{
+		"SCRAM-SHA-1":   NewScramSHA1Mechanism,
+		"SCRAM-SHA-256": NewScramSHA256Mechanism,
+		"SCRAM-SHA-512": NewScramSHA512Mechanism,
+	} {
+		name, newScram := name, newScram
+		RegisterMechanism(name, func(credentials Credentials) (Mechanism, error) {
+			if err := requirePassword(name, credentials); err != nil {
+				return nil, err
+			}
+			mechanism := newScram(credentials.Username, credentials.Password)
+			mechanism.TLS = credentials.TLS
+			return mechanism, nil
+		})
+		RegisterMechanism(name+"-PLUS", func(credentials Credentials) (Mechanism, error) {
+			if credentials.TLS == nil {
+				return nil, newError(name+"-PLUS", ErrMissingCredentials, "a TLS connection is required")
+			}
+			if err := requirePassword(name+"-PLUS", credentials); err != nil {
+				return nil, err
+			}
+			return newScramPlusMechanism(newScram(credentials.Username, credentials.Password), credentials.TLS), nil
+		})
+	}
+}
+
+// RegisterMechanism makes a mechanism available under the given SASL name. Registering a
+// name twice replaces the previous factory, which allows overriding the built-in mechanisms.
+func RegisterMechanism(name string, factory MechanismFactory) {
+	if factory == nil {
+		panic("gosasl: RegisterMechanism factory is nil")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToUpper(name)] = factory
+}
+
+// NewMechanism builds the mechanism registered under the given SASL name
+func NewMechanism(name string, credentials Credentials) (Mechanism, error) {
+	registryMu.RLock()
+	factory, ok := registry[strings.ToUpper(name)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, newError(name, ErrUnsupportedMechanism, "not registered")
+	}
+	mechanism, err := factory(credentials)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.AuthorizationID != "" {
+		mechanism.Config().AuthorizationID = credentials.AuthorizationID
+	}
+	if credentials.Callbacks != nil {
+		mechanism.Config().callbacks = credentials.Callbacks
+	}
+	return mechanism, nil
+}
+
+// Mechanisms returns the sorted names of all the registered mechanisms
+func Mechanisms() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegisterServerMechanism makes a server mechanism available under the given SASL name to
+// the servers that let the client choose, see Server.AdvertisedMechanisms. There are no
+// built-in server mechanisms as they need the user database of the application.
+func RegisterServerMechanism(name string, factory ServerMechanismFactory) {
+	if factory == nil {
+		panic("gosasl: RegisterServerMechanism factory is nil")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	serverRegistry[strings.ToUpper(name)] = factory
+}
+
+// ServerMechanisms returns the sorted names of all the registered server mechanisms
+func ServerMechanisms() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(serverRegistry))
+	for name := range serverRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newServerMechanism builds the server mechanism registered under the given SASL name
+func newServerMechanism(name string, conn ConnectionInfo) (ServerMechanism, error) {
+	registryMu.RLock()
+	factory, ok := serverRegistry[strings.ToUpper(name)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, newError(name, ErrUnsupportedMechanism, "not registered")
+	}
+	return factory(conn)
+}
+
+// rank orders the mechanisms for NewSaslClientFromOffer. It starts from the score and
+// favors the mechanisms that resist active and dictionary attacks over the ones sending
+// the password in the clear or allowing anonymous logins.
+func rank(config *MechanismConfig) int {
+	rank := config.score
+	if config.activeSafe {
+		rank += 20
+	}
+	if config.dictionarySafe {
+		rank += 20
+	}
+	if config.usesPlaintext {
+		rank -= 20
+	}
+	if config.allowsAnonymous {
+		rank -= 40
+	}
+	return rank
+}
+
+// NewSaslClientFromOffer picks the strongest registered mechanism among the ones offered by
+// the server, e.g. in an IMAP CAPABILITY or SMTP EHLO response, and returns a client for it.
+// Mechanisms are ranked by their score and their security properties, see rank, even when
+// no SecurityPolicy is given. Mechanisms that can't be built with the given credentials,
+// e.g. GSSAPI without a Kerberos ticket, or rejected by the options, e.g. WithSecurityPolicy,
+// are skipped. So are ANONYMOUS and EXTERNAL when a password is given, unless
+// Credentials.AllowPasswordless is set. When several mechanisms have the same rank the one
+// offered first wins.
+func NewSaslClientFromOffer(host string, offered []string, credentials Credentials, opts ...Option) (*Client, error) {
+	var best *Client
+	for _, name := range offered {
+		if passwordless[strings.ToUpper(name)] && credentials.hasPassword() && !credentials.AllowPasswordless {
+			continue
+		}
+		mechanism, err := NewMechanism(name, credentials)
+		if err != nil {
+			continue
+		}
+		client, err := NewSaslClientWithOptions(host, mechanism, opts...)
+		if err != nil {
+			mechanism.Dispose()
+			continue
+		}
+		if best == nil || rank(mechanism.Config()) > rank(best.GetConfig()) {
+			if best != nil {
+				best.Dispose()
+			}
+			best = client
+		} else {
+			client.Dispose()
+		}
+	}
+	if best == nil {
+		return nil, newError("", ErrUnsupportedMechanism, "none of the offered mechanisms %v can be used", offered)
+	}
+	return best, nil
+}
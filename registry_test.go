@@ -0,0 +1,149 @@
+package gosasl
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewMechanismByName(t *testing.T) {
+	credentials := Credentials{Service: "imap", Username: "user", Password: "password", AuthorizationID: "authId"}
+	for name, expected := range map[string]string{
+		"ANONYMOUS":  "ANONYMOUS",
+		"PLAIN":      "PLAIN",
+		"plain":      "PLAIN",
+		"CRAM-MD5":   "CRAM-MD5",
+		"DIGEST-MD5": "DIGEST-MD5",
+	} {
+		mechanism, err := NewMechanism(name, credentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mechanism.Config().Name(); got != expected {
+			t.Fatalf("Expected mechanism %s, got %s", expected, got)
+		}
+		if mechanism.Config().AuthorizationID != "authId" {
+			t.Fatalf("AuthorizationID was not set on %s", name)
+		}
+	}
+}
+
+func TestNewMechanismErrors(t *testing.T) {
+	if _, err := NewMechanism("X-UNKNOWN", Credentials{}); err == nil {
+		t.Fatal("Unknown mechanism should fail")
+	}
+	if _, err := NewMechanism("PLAIN", Credentials{}); err == nil {
+		t.Fatal("PLAIN without a username should fail")
+	}
+	for _, name := range []string{"PLAIN", "LOGIN", "CRAM-MD5", "DIGEST-MD5", "SCRAM-SHA-256"} {
+		if _, err := NewMechanism(name, Credentials{Service: "imap", Username: "user"}); !errors.Is(err, ErrMissingCredentials) {
+			t.Fatalf("%s without a password should fail, got %v", name, err)
+		}
+	}
+}
+
+func TestRegisterMechanism(t *testing.T) {
+	RegisterMechanism("X-REGISTRY-TEST", func(credentials Credentials) (Mechanism, error) {
+		return NewPlainMechanism(credentials.Username, credentials.Password), nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "X-REGISTRY-TEST")
+		registryMu.Unlock()
+	}()
+
+	found := false
+	for _, name := range Mechanisms() {
+		found = found || name == "X-REGISTRY-TEST"
+	}
+	if !found {
+		t.Fatalf("Registered mechanism missing from %v", Mechanisms())
+	}
+
+	mechanism, err := NewMechanism("x-registry-test", Credentials{Username: "user", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ := mechanism.Start()
+	if !reflect.DeepEqual(response, []byte("\x00user\x00password")) {
+		t.Fatalf("Unexpected response %q", response)
+	}
+}
+
+func TestNewSaslClientFromOffer(t *testing.T) {
+	credentials := Credentials{Service: "imap", Username: "user", Password: "password"}
+	cases := []struct {
+		offered  []string
+		expected string
+	}{
+		{[]string{"PLAIN", "DIGEST-MD5", "CRAM-MD5"}, "DIGEST-MD5"},
+		{[]string{"ANONYMOUS", "plain"}, "PLAIN"},
+		{[]string{"X-UNKNOWN", "CRAM-MD5", "PLAIN"}, "CRAM-MD5"},
+	}
+	for _, c := range cases {
+		client, err := NewSaslClientFromOffer("localhost", c.offered, credentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := client.GetConfig().Name(); got != c.expected {
+			t.Fatalf("Offer %v: expected %s, got %s", c.offered, c.expected, got)
+		}
+	}
+}
+
+func TestNewSaslClientFromOfferDowngrade(t *testing.T) {
+	credentials := Credentials{Username: "user", Password: "password"}
+	for _, offered := range [][]string{{"ANONYMOUS"}, {"EXTERNAL", "ANONYMOUS"}} {
+		if _, err := NewSaslClientFromOffer("localhost", offered, credentials); !errors.Is(err, ErrUnsupportedMechanism) {
+			t.Fatalf("Offer %v: expected ErrUnsupportedMechanism, got %v", offered, err)
+		}
+	}
+	credentials.AllowPasswordless = true
+	client, err := NewSaslClientFromOffer("localhost", []string{"ANONYMOUS"}, credentials)
+	if err != nil || client.GetConfig().Name() != "ANONYMOUS" {
+		t.Fatalf("Expected ANONYMOUS once allowed: %v", err)
+	}
+}
+
+func TestNewSaslClientFromOfferWithoutCredentials(t *testing.T) {
+	client, err := NewSaslClientFromOffer("localhost", []string{"PLAIN", "ANONYMOUS"}, Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetConfig().Name() != "ANONYMOUS" {
+		t.Fatalf("Expected ANONYMOUS, got %s", client.GetConfig().Name())
+	}
+	if _, err := NewSaslClientFromOffer("localhost", []string{"PLAIN", "X-UNKNOWN"}, Credentials{}); err == nil {
+		t.Fatal("No usable mechanism should fail")
+	}
+}
+
+func TestNewSaslClientFromOfferRanking(t *testing.T) {
+	newMechanism := func(name string, score int, safe bool) MechanismFactory {
+		return func(credentials Credentials) (Mechanism, error) {
+			config := NewMechanismConfig(name)
+			config.SetScore(score)
+			config.allowsAnonymous = false
+			config.usesPlaintext = !safe
+			config.activeSafe = safe
+			config.dictionarySafe = safe
+			return &reverseMechanism{config: config}, nil
+		}
+	}
+	RegisterMechanism("X-RANK-PLAINTEXT", newMechanism("X-RANK-PLAINTEXT", 40, false))
+	RegisterMechanism("X-RANK-SAFE", newMechanism("X-RANK-SAFE", 10, true))
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "X-RANK-PLAINTEXT")
+		delete(registry, "X-RANK-SAFE")
+		registryMu.Unlock()
+	}()
+
+	client, err := NewSaslClientFromOffer("localhost", []string{"X-RANK-PLAINTEXT", "X-RANK-SAFE"}, Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.GetConfig().Name(); got != "X-RANK-SAFE" {
+		t.Fatalf("Expected the mechanism resisting attacks to win over the higher score, got %s", got)
+	}
+}
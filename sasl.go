@@ -1,14 +1,20 @@
 package gosasl
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
+	"io"
+	"log"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -42,27 +48,109 @@ type QOP []byte
 
 // MechanismConfig is the configuration to use for mechanisms
 type MechanismConfig struct {
-	name               string
-	score              int
-	complete           bool
-	hasInitialResponse bool
-	allowsAnonymous    bool
-	usesPlaintext      bool
-	activeSafe         bool
-	dictionarySafe     bool
-	qop                QOP
-	// It can be set with mechanism.getConfig().AuthorizationID = "authorizationId"
+	name            string
+	score           int
+	complete        bool
+	allowsAnonymous bool
+	usesPlaintext   bool
+	activeSafe      bool
+	dictionarySafe  bool
+	mutualAuth      bool
+	// channelBinding is set for mechanisms bound to the TLS connection, through channel
+	// binding or the client certificate, that can only run over TLS
+	channelBinding bool
+	// qop holds the QOP flags the mechanism is able to provide
+	qop QOP
+	// negotiatedQop is the QOP flag chosen during the handshake
+	negotiatedQop byte
+	policy        *SecurityPolicy
+	// identity is the identity that was authenticated
+	identity string
+	// maxBuffer and peerMaxBuffer are the max buffer sizes agreed for the security layer
+	maxBuffer     int
+	peerMaxBuffer int
+	randomSource  io.Reader
+	logger        Logger
+	callbacks     CallbackHandler
+	// It can be set with mechanism.Config().AuthorizationID = "authorizationId"
 	AuthorizationID string
 }
 
-// Mechanism is the common interface for all mechanisms
+// NewMechanismConfig returns the default configuration for a mechanism with the given
+// SASL name. Mechanisms implemented outside this package should use it to build the
+// configuration returned by their Config method.
+func NewMechanismConfig(name string) *MechanismConfig {
+	return newDefaultConfig(name)
+}
+
+// Name returns the SASL name of the mechanism, e.g. "PLAIN"
+func (c *MechanismConfig) Name() string {
+	return c.name
+}
+
+// Complete returns true if the mechanism has finished the handshake
+func (c *MechanismConfig) Complete() bool {
+	return c.complete
+}
+
+// SetComplete marks the handshake as finished. Mechanisms call it once the last
+// message of the exchange has been produced or verified.
+func (c *MechanismConfig) SetComplete(complete bool) {
+	c.complete = complete
+}
+
+// supportedQop returns the QOP flags the mechanism can provide. Mechanisms that don't
+// declare any only provide authentication.
+func (c *MechanismConfig) supportedQop() byte {
+	if len(c.qop) == 0 {
+		return QOP_TO_FLAG[AUTH]
+	}
+	return c.qop[0]
+}
+
+// random returns the source of randomness for nonces, crypto/rand unless set with WithRandom
+func (c *MechanismConfig) random() io.Reader {
+	if c.randomSource == nil {
+		return rand.Reader
+	}
+	return c.randomSource
+}
+
+// logf logs with the logger set with WithLogger, or the standard logger
+func (c *MechanismConfig) logf(format string, args ...interface{}) {
+	if c.logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	c.logger.Printf(format, args...)
+}
+
+// Score returns how strong the mechanism is considered when picking one out of the
+// mechanisms offered by a server. Higher is stronger.
+func (c *MechanismConfig) Score() int {
+	return c.score
+}
+
+// SetScore sets the strength of the mechanism, see Score
+func (c *MechanismConfig) SetScore(score int) {
+	c.score = score
+}
+
+// Mechanism is the common interface for all mechanisms. It can be implemented outside
+// this package to plug custom mechanisms into a Client.
 type Mechanism interface {
-	start() ([]byte, error)
-	step(challenge []byte) ([]byte, error)
-	encode(outgoing []byte) ([]byte, error)
-	decode(incoming []byte) ([]byte, error)
-	dispose()
-	getConfig() *MechanismConfig
+	// Start returns the initial response, if the mechanism has one
+	Start() ([]byte, error)
+	// Step processes a challenge from the server and returns the response to send back
+	Step(challenge []byte) ([]byte, error)
+	// Encode is applied on the outgoing bytes once the security layer is established
+	Encode(outgoing []byte) ([]byte, error)
+	// Decode is applied on the incoming bytes once the security layer is established
+	Decode(incoming []byte) ([]byte, error)
+	// Dispose eliminates sensitive information
+	Dispose()
+	// Config returns the configuration of the mechanism
+	Config() *MechanismConfig
 }
 
 // AnonymousMechanism corresponds to NONE/ Anonymous SASL mechanism
@@ -72,31 +160,81 @@ type AnonymousMechanism struct {
 
 // NewAnonymousMechanism returns a new AnonymousMechanism
 func NewAnonymousMechanism() *AnonymousMechanism {
+	config := newDefaultConfig("ANONYMOUS")
+	config.usesPlaintext = false
 	return &AnonymousMechanism{
-		config: newDefaultConfig("Anonymous"),
+		config: config,
 	}
 }
 
-func (m *AnonymousMechanism) start() ([]byte, error) {
-	return m.step(nil)
+func (m *AnonymousMechanism) Start() ([]byte, error) {
+	return m.Step(nil)
 }
 
-func (m *AnonymousMechanism) step([]byte) ([]byte, error) {
+func (m *AnonymousMechanism) Step([]byte) ([]byte, error) {
 	m.config.complete = true
 	return []byte("Anonymous, None"), nil
 }
 
-func (m *AnonymousMechanism) encode([]byte) ([]byte, error) {
+func (m *AnonymousMechanism) Encode([]byte) ([]byte, error) {
 	return nil, nil
 }
 
-func (m *AnonymousMechanism) decode([]byte) ([]byte, error) {
+func (m *AnonymousMechanism) Decode([]byte) ([]byte, error) {
+	return nil, nil
+}
+
+func (m *AnonymousMechanism) Dispose() {}
+
+func (m *AnonymousMechanism) Config() *MechanismConfig {
+	return m.config
+}
+
+// AnonymousServerMechanism is the server side of the ANONYMOUS SASL mechanism
+type AnonymousServerMechanism struct {
+	config *MechanismConfig
+	// Trace is the trace information sent by the client, see RFC 4505
+	Trace string
+}
+
+// NewAnonymousServerMechanism returns a new AnonymousServerMechanism
+func NewAnonymousServerMechanism() *AnonymousServerMechanism {
+	config := newDefaultConfig("ANONYMOUS")
+	config.usesPlaintext = false
+	return &AnonymousServerMechanism{
+		config: config,
+	}
+}
+
+func (m *AnonymousServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		// Ask for the trace information with an empty challenge
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+func (m *AnonymousServerMechanism) Step(response []byte) ([]byte, error) {
+	if !utf8.Valid(response) || utf8.RuneCount(response) > 255 {
+		return nil, newError(m.config.name, ErrProtocol, "invalid trace information")
+	}
+	m.Trace = string(response)
+	m.config.identity = "anonymous"
+	m.config.complete = true
 	return nil, nil
 }
 
-func (m *AnonymousMechanism) dispose() {}
+func (m *AnonymousServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *AnonymousServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *AnonymousServerMechanism) Dispose() {}
 
-func (m *AnonymousMechanism) getConfig() *MechanismConfig {
+func (m *AnonymousServerMechanism) Config() *MechanismConfig {
 	return m.config
 }
 
@@ -110,19 +248,41 @@ type PlainMechanism struct {
 
 // NewPlainMechanism returns a new PlainMechanism
 func NewPlainMechanism(username string, password string) *PlainMechanism {
+	config := newDefaultConfig("PLAIN")
+	config.score = 1
+	config.allowsAnonymous = false
 	return &PlainMechanism{
-		mechanismConfig: newDefaultConfig("PLAIN"),
+		mechanismConfig: config,
 		username:        username,
 		password:        password,
 	}
 }
 
-func (m *PlainMechanism) start() ([]byte, error) {
-	return m.step(nil)
+func (m *PlainMechanism) Start() ([]byte, error) {
+	return m.Step(nil)
 }
 
-func (m *PlainMechanism) step(challenge []byte) ([]byte, error) {
+// resolveCredentials asks the callback handler for the credentials that weren't given
+func (m *PlainMechanism) resolveCredentials() error {
+	pending := &pendingCallbacks{}
+	pending.add(&m.username, &Callback{ID: CallbackUsername, Prompt: "Username"})
+	pending.add(&m.password, &Callback{ID: CallbackPassword, Prompt: "Password"})
+	pending.add(&m.mechanismConfig.AuthorizationID, &Callback{ID: CallbackAuthorizationID, Prompt: "Authorization ID"})
+	if err := m.mechanismConfig.interact(pending); err != nil {
+		return err
+	}
+	if m.username == "" {
+		return newError(m.mechanismConfig.name, ErrMissingCredentials, "no username was provided")
+	}
+	return nil
+}
+
+func (m *PlainMechanism) Step(challenge []byte) ([]byte, error) {
+	if err := m.resolveCredentials(); err != nil {
+		return nil, err
+	}
 	m.mechanismConfig.complete = true
+	m.mechanismConfig.identity = m.username
 	var authID string
 
 	if m.mechanismConfig.AuthorizationID != "" {
@@ -134,47 +294,257 @@ func (m *PlainMechanism) step(challenge []byte) ([]byte, error) {
 	return []byte(fmt.Sprintf("%s%s%s%s%s", authID, NULL, m.username, NULL, m.password)), nil
 }
 
-func (m *PlainMechanism) encode(outgoing []byte) ([]byte, error) {
+func (m *PlainMechanism) Encode(outgoing []byte) ([]byte, error) {
 	return outgoing, nil
 }
 
-func (m *PlainMechanism) decode(incoming []byte) ([]byte, error) {
+func (m *PlainMechanism) Decode(incoming []byte) ([]byte, error) {
 	return incoming, nil
 }
 
-func (m *PlainMechanism) dispose() {
+func (m *PlainMechanism) Dispose() {
 	m.password = ""
 }
 
-func (m *PlainMechanism) getConfig() *MechanismConfig {
+func (m *PlainMechanism) Config() *MechanismConfig {
 	return m.mechanismConfig
 }
 
-// CramMD5Mechanism corresponds to PLAIN SASL mechanism
+// PLAIN_MAX_FIELD_LENGTH is the default max length in bytes of each field of a PLAIN
+// message. RFC 4616 requires servers to accept at least 255 bytes.
+const PLAIN_MAX_FIELD_LENGTH = 255
+
+// PlainServerMechanism is the server side of the PLAIN SASL mechanism
+type PlainServerMechanism struct {
+	mechanismConfig *MechanismConfig
+	verifier        Verifier
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+	// MaxFieldLength is the max length in bytes of the authzid, authcid and passwd
+	MaxFieldLength int
+	// Guard limits the failed attempts, see BruteForceGuard
+	Guard *BruteForceGuard
+	// RemoteAddress is the address of the client, see BruteForceGuard
+	RemoteAddress string
+}
+
+// NewPlainServerMechanism returns a new PlainServerMechanism that checks passwords with the verifier
+func NewPlainServerMechanism(verifier Verifier) *PlainServerMechanism {
+	config := newDefaultConfig("PLAIN")
+	config.score = 1
+	config.allowsAnonymous = false
+	return &PlainServerMechanism{
+		mechanismConfig: config,
+		verifier:        verifier,
+		MaxFieldLength:  PLAIN_MAX_FIELD_LENGTH,
+	}
+}
+
+func (m *PlainServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		// Ask for the message with an empty challenge
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+// parseMessage splits message = [authzid] NUL authcid NUL passwd, see RFC 4616
+func (m *PlainServerMechanism) parseMessage(response []byte) (authzid, authcid, passwd string, err error) {
+	if !utf8.Valid(response) {
+		return "", "", "", newError(m.mechanismConfig.name, ErrProtocol, "the message isn't valid UTF-8")
+	}
+	fields := strings.Split(string(response), "\x00")
+	if len(fields) != 3 {
+		return "", "", "", newError(m.mechanismConfig.name, ErrProtocol, "the message should have exactly two NUL separators")
+	}
+	for _, field := range fields {
+		if len(field) > m.MaxFieldLength {
+			return "", "", "", newError(m.mechanismConfig.name, ErrProtocol, "a field is longer than %d bytes", m.MaxFieldLength)
+		}
+	}
+	if fields[1] == "" || fields[2] == "" {
+		return "", "", "", newError(m.mechanismConfig.name, ErrProtocol, "the authcid and passwd can't be empty")
+	}
+	return fields[0], fields[1], fields[2], nil
+}
+
+func (m *PlainServerMechanism) Step(response []byte) ([]byte, error) {
+	authzid, authcid, passwd, err := m.parseMessage(response)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Guard.attempt(m.mechanismConfig.name, authcid, m.RemoteAddress, func() error {
+		return verify(m.mechanismConfig, m.verifier, authcid, passwd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(m.mechanismConfig, m.Authorizer, authcid, authzid); err != nil {
+		return nil, err
+	}
+	m.mechanismConfig.complete = true
+	return nil, nil
+}
+
+func (m *PlainServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *PlainServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *PlainServerMechanism) Dispose() {}
+
+func (m *PlainServerMechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
+}
+
+// CramMD5Mechanism corresponds to CRAM-MD5 SASL mechanism
 type CramMD5Mechanism struct {
 	*PlainMechanism
 }
 
-// NewCramMD5Mechanism returns a new PlainMechanism
+// NewCramMD5Mechanism returns a new CramMD5Mechanism
 func NewCramMD5Mechanism(username string, password string) *CramMD5Mechanism {
 	plain := NewPlainMechanism(username, password)
+	config := newDefaultConfig("CRAM-MD5")
+	config.score = 20
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	plain.mechanismConfig = config
 	return &CramMD5Mechanism{
 		plain,
 	}
 }
 
-func (m *CramMD5Mechanism) step(challenge []byte) ([]byte, error) {
+// Start doesn't produce anything, CRAM-MD5 has no initial response
+func (m *CramMD5Mechanism) Start() ([]byte, error) {
+	return m.Step(nil)
+}
+
+func (m *CramMD5Mechanism) Step(challenge []byte) ([]byte, error) {
 	if challenge == nil {
 		return nil, nil
 	}
+	if err := m.resolveCredentials(); err != nil {
+		return nil, err
+	}
 	m.mechanismConfig.complete = true
+	m.mechanismConfig.identity = m.username
 	hash := hmac.New(md5.New, []byte(m.password))
-	// hashed := make([]byte, hash.Size())
 	_, err := hash.Write(challenge)
 	if err != nil {
 		return nil, err
 	}
-	return append([]byte(fmt.Sprintf("%s ", m.username)), hash.Sum(nil)...), nil
+	// The digest is sent in lowercase hex, see RFC 2195
+	return []byte(m.username + " " + hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// CramMD5ServerMechanism is the server side of the CRAM-MD5 SASL mechanism
+type CramMD5ServerMechanism struct {
+	mechanismConfig *MechanismConfig
+	secrets         SecretLookup
+	challenge       []byte
+	// Hostname is used in the challenge, <random.timestamp@hostname>
+	Hostname string
+	// Random is the source of randomness for the challenge, crypto/rand if nil
+	Random io.Reader
+	// Now is the clock used for the challenge timestamp, time.Now if nil
+	Now func() time.Time
+	// Guard limits the failed attempts, see BruteForceGuard
+	Guard *BruteForceGuard
+	// RemoteAddress is the address of the client, see BruteForceGuard
+	RemoteAddress string
+}
+
+// NewCramMD5ServerMechanism returns a new CramMD5ServerMechanism that looks up the
+// passwords of the users with secrets
+func NewCramMD5ServerMechanism(hostname string, secrets SecretLookup) *CramMD5ServerMechanism {
+	config := newDefaultConfig("CRAM-MD5")
+	config.score = 20
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	return &CramMD5ServerMechanism{
+		mechanismConfig: config,
+		secrets:         secrets,
+		Hostname:        hostname,
+	}
+}
+
+// Start returns the challenge, see RFC 2195. CRAM-MD5 has no initial response.
+func (m *CramMD5ServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if len(initialResponse) != 0 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "CRAM-MD5 has no initial response")
+	}
+	random := m.Random
+	if random == nil {
+		random = rand.Reader
+	}
+	now := time.Now
+	if m.Now != nil {
+		now = m.Now
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return nil, err
+	}
+	m.challenge = []byte(fmt.Sprintf("<%d.%d@%s>", binary.BigEndian.Uint64(b), now().Unix(), m.Hostname))
+	return m.challenge, nil
+}
+
+// Step verifies the "user digest" reply, the digest is in lowercase hex as per RFC 2195
+func (m *CramMD5ServerMechanism) Step(response []byte) ([]byte, error) {
+	if m.challenge == nil {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the challenge hasn't been sent")
+	}
+	digest := make([]byte, md5.Size)
+	i := bytes.LastIndexByte(response, ' ')
+	if i <= 0 || len(response)-i-1 != hex.EncodedLen(md5.Size) {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the response should be \"user digest\"")
+	}
+	if _, err := hex.Decode(digest, response[i+1:]); err != nil {
+		return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrProtocol, Message: "the digest isn't hex", Err: err}
+	}
+	username := string(response[:i])
+	if !utf8.ValidString(username) {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the user name isn't valid UTF-8")
+	}
+
+	err := m.Guard.attempt(m.mechanismConfig.name, username, m.RemoteAddress, func() error {
+		secret, found, err := lookupSecret(m.mechanismConfig, m.secrets, username)
+		if err != nil {
+			return err
+		}
+		hash := hmac.New(md5.New, []byte(secret))
+		hash.Write(m.challenge)
+		if !matchProof(hash.Sum(nil), digest, found) {
+			return newError(m.mechanismConfig.name, ErrBadCredentials, "invalid digest for %s", username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.mechanismConfig.identity = username
+	m.mechanismConfig.complete = true
+	return nil, nil
+}
+
+func (m *CramMD5ServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *CramMD5ServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *CramMD5ServerMechanism) Dispose() {
+	m.challenge = nil
+}
+
+func (m *CramMD5ServerMechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
 }
 
 // DigestMD5Mechanism corresponds to PLAIN SASL mechanism
@@ -190,27 +560,56 @@ type DigestMD5Mechanism struct {
 	nonce           string
 	keyHash         string
 	auth            string
+	realm           string
+	// UserSelectQop restricts the QOP values that can be negotiated, see GSSAPIMechanism.UserSelectQop
+	UserSelectQop uint8
+}
+
+// directive is a key=value pair of a DIGEST-MD5 challenge
+type directive struct {
+	key   string
+	value string
 }
 
 // parseChallenge turns the challenge string into a map
-func parseChallenge(challenge []byte) map[string]string {
+func parseChallenge(challenge []byte) (map[string]string, error) {
+	directives, err := parseDirectives(challenge)
+	if err != nil {
+		return nil, err
+	}
+	c := make(map[string]string)
+	for _, d := range directives {
+		c[d.key] = d.value
+	}
+	return c, nil
+}
+
+// parseDirectives splits the challenge string into its directives, keeping repeated ones
+// like realm
+func parseDirectives(challenge []byte) ([]directive, error) {
 	s := string(challenge)
 
-	c := make(map[string]string)
+	var c []directive
 
 	for len(s) > 0 {
 		eq := strings.Index(s, "=")
-		key := s[:eq]
+		if eq <= 0 {
+			return nil, fmt.Errorf("directive without a value in %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
 		s = s[eq+1:]
 		isQuoted := false
 		search := ","
-		if s[0:1] == "\"" {
+		if strings.HasPrefix(s, "\"") {
 			isQuoted = true
 			search = "\""
 			s = s[1:]
 		}
 		co := strings.Index(s, search)
 		if co == -1 {
+			if isQuoted {
+				return nil, fmt.Errorf("unterminated quoted value for %s", key)
+			}
 			co = len(s)
 		}
 		val := s[:co]
@@ -221,34 +620,46 @@ func parseChallenge(challenge []byte) map[string]string {
 		} else {
 			s = ""
 		}
-		c[key] = val
+		c = append(c, directive{key, val})
 	}
 
-	return c
+	return c, nil
 }
 
 // NewDigestMD5Mechanism returns a new PlainMechanism
 func NewDigestMD5Mechanism(service string, username string, password string) *DigestMD5Mechanism {
+	config := newDefaultConfig("DIGEST-MD5")
+	config.score = 30
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.mutualAuth = true
+	// Only authentication is implemented, the security layers are not
+	config.qop = QOP{QOP_TO_FLAG[AUTH]}
 	return &DigestMD5Mechanism{
-		mechanismConfig: newDefaultConfig("DIGEST-MD5"),
+		mechanismConfig: config,
 		service:         service,
 		username:        username,
 		password:        password,
+		UserSelectQop:   QOP_TO_FLAG[AUTH] | QOP_TO_FLAG[AUTH_INT] | QOP_TO_FLAG[AUTH_CONF],
 	}
 }
 
-func (m *DigestMD5Mechanism) start() ([]byte, error) {
-	return m.step(nil)
+func (m *DigestMD5Mechanism) Start() ([]byte, error) {
+	return m.Step(nil)
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
-func randSeq(n int) string {
+func randSeq(random io.Reader, n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return "", err
+	}
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		b[i] = letters[int(buf[i])%len(letters)]
 	}
-	return string(b)
+	return string(b), nil
 }
 
 func (m *DigestMD5Mechanism) authenticate(digestUri string, challengeMap map[string]string) error {
@@ -259,26 +670,36 @@ func (m *DigestMD5Mechanism) authenticate(digestUri string, challengeMap map[str
 	}
 
 	if m.getHash(digestUri, a2String, challengeMap) != challengeMap["rspauth"] {
-		return fmt.Errorf("authenticate failed")
+		return newError(m.mechanismConfig.name, ErrServerAuthentication, "rspauth doesn't match")
 	}
 	return nil
 }
 
 func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string, c map[string]string) string {
-	// Create a1: HEX(H(H(username:realm:password):nonce:cnonce:authid))
 	if m.keyHash == "" {
-		x := m.username + ":" + c["realm"] + ":" + m.password
-		byteKeyHash := md5.Sum([]byte(x))
-		m.keyHash = string(byteKeyHash[:])
+		m.keyHash = digestKeyHash(m.username, c["realm"], m.password)
 	}
+	return digestHash(m.keyHash, m.nonce, m.nonceCount, m.cnonce, m.mechanismConfig.AuthorizationID, m.auth, a2String)
+}
+
+// digestKeyHash computes H(username:realm:password)
+func digestKeyHash(username string, realm string, password string) string {
+	byteKeyHash := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return string(byteKeyHash[:])
+}
+
+// digestHash computes the response value of RFC 2831 given H(username:realm:password)
+// and the A2 string. It is used for both the client response and the server rspauth.
+func digestHash(keyHash string, nonce string, nonceCount int, cnonce string, authorizationID string, qop string, a2String string) string {
+	// Create a1: HEX(H(H(username:realm:password):nonce:cnonce:authid))
 	a1String := []string{
-		m.keyHash,
-		m.nonce,
-		m.cnonce,
+		keyHash,
+		nonce,
+		cnonce,
 	}
 
-	if len(m.mechanismConfig.AuthorizationID) != 0 {
-		a1String = append(a1String, m.mechanismConfig.AuthorizationID)
+	if len(authorizationID) != 0 {
+		a1String = append(a1String, authorizationID)
 	}
 
 	h1 := md5.Sum([]byte(strings.Join(a1String, ":")))
@@ -288,37 +709,64 @@ func (m *DigestMD5Mechanism) getHash(digestUri string, a2String string, c map[st
 	a2 := hex.EncodeToString(h2[:])
 
 	// Set nonce count nc
-	nc := fmt.Sprintf("%08x", m.nonceCount)
+	nc := fmt.Sprintf("%08x", nonceCount)
 
 	// Create response: H(a1:nonce:nc:cnonce:qop:a2)
-	r := strings.ToLower(a1) + ":" + m.nonce + ":" + nc + ":" + m.cnonce + ":" + m.auth + ":" + strings.ToLower(a2)
+	r := strings.ToLower(a1) + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + strings.ToLower(a2)
 	hr := md5.Sum([]byte(r))
 
 	// Convert response to hex
-	response := strings.ToLower(hex.EncodeToString(hr[:]))
-	return string(response)
-
+	return strings.ToLower(hex.EncodeToString(hr[:]))
 }
 
-func (m *DigestMD5Mechanism) step(challenge []byte) ([]byte, error) {
+func (m *DigestMD5Mechanism) Step(challenge []byte) ([]byte, error) {
 	if challenge == nil {
 		return nil, nil
 	}
 
 	// Create map of challenge
-	c := parseChallenge(challenge)
+	directives, err := parseDirectives(challenge)
+	if err != nil {
+		return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrProtocol, Message: "malformed challenge", Err: err}
+	}
+	c := make(map[string]string)
+	var realms []string
+	for _, d := range directives {
+		c[d.key] = d.value
+		if d.key == "realm" {
+			realms = append(realms, d.value)
+		}
+	}
 	digestUri := m.service + "/" + m.host
 
 	if _, ok := c["rspauth"]; ok {
+		if err := m.authenticate(digestUri, c); err != nil {
+			return nil, err
+		}
 		m.mechanismConfig.complete = true
-		return nil, m.authenticate(digestUri, c)
+		m.mechanismConfig.identity = m.username
+		return nil, nil
 	}
 
 	// Prepare response variables
 	m.nonce = c["nonce"]
-	m.auth = c["qop"]
+	if m.nonce == "" {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the challenge has no nonce")
+	}
+	qop, err := m.selectQop(c["qop"])
+	if err != nil {
+		return nil, err
+	}
+	m.auth = qopName(qop)
+	m.mechanismConfig.negotiatedQop = qop
+	if err := m.resolveCredentials(realms); err != nil {
+		return nil, err
+	}
+	c["realm"] = m.realm
 	if m.nonceCount == 0 {
-		m.cnonce = randSeq(14)
+		if m.cnonce, err = randSeq(m.mechanismConfig.random(), 14); err != nil {
+			return nil, err
+		}
 	}
 	m.nonceCount++
 
@@ -326,59 +774,275 @@ func (m *DigestMD5Mechanism) step(challenge []byte) ([]byte, error) {
 	a2String := "AUTHENTICATE:" + digestUri
 
 	maxBuf := ""
-	if c["qop"] != AUTH {
+	if m.auth != AUTH {
 		a2String += ":00000000000000000000000000000000"
 		maxBuf = ",maxbuf=16777215"
 	}
 	// Set nonce count nc
 	nc := fmt.Sprintf("%08x", m.nonceCount)
 	// Create final response sent to server
-	resp := "qop=" + c["qop"] + ",realm=" + strconv.Quote(c["realm"]) + ",username=" + strconv.Quote(m.username) + ",nonce=" + strconv.Quote(m.nonce) +
+	resp := "qop=" + m.auth + ",realm=" + strconv.Quote(c["realm"]) + ",username=" + strconv.Quote(m.username) + ",nonce=" + strconv.Quote(m.nonce) +
 		",cnonce=" + strconv.Quote(m.cnonce) + ",nc=" + nc + ",digest-uri=" + strconv.Quote(digestUri) + ",response=" + m.getHash(digestUri, a2String, c) + maxBuf
+	if m.mechanismConfig.AuthorizationID != "" {
+		resp += ",authzid=" + strconv.Quote(m.mechanismConfig.AuthorizationID)
+	}
 
 	return []byte(resp), nil
 }
 
-func (m *DigestMD5Mechanism) encode(outgoing []byte) ([]byte, error) {
+// resolveCredentials asks the callback handler for the credentials that weren't given and
+// for the realm to use when the server offers several
+func (m *DigestMD5Mechanism) resolveCredentials(realms []string) error {
+	pending := &pendingCallbacks{}
+	pending.add(&m.username, &Callback{ID: CallbackUsername, Prompt: "Username"})
+	pending.add(&m.password, &Callback{ID: CallbackPassword, Prompt: "Password"})
+	pending.add(&m.mechanismConfig.AuthorizationID, &Callback{ID: CallbackAuthorizationID, Prompt: "Authorization ID"})
+	if len(realms) > 1 {
+		pending.add(&m.realm, &Callback{ID: CallbackRealm, Prompt: "Realm", Choices: realms, Default: realms[0]})
+	}
+	if err := m.mechanismConfig.interact(pending); err != nil {
+		return err
+	}
+	if m.realm == "" && len(realms) > 0 {
+		m.realm = realms[0]
+	}
+	if m.username == "" {
+		return newError(m.mechanismConfig.name, ErrMissingCredentials, "no username was provided")
+	}
+	return nil
+}
+
+// selectQop picks the strongest QOP offered by the server that the mechanism, the user
+// and the security policy accept. A missing qop directive means "auth", see RFC 2831.
+func (m *DigestMD5Mechanism) selectQop(offered string) (byte, error) {
+	if offered == "" {
+		offered = AUTH
+	}
+	availableQops := m.UserSelectQop & m.mechanismConfig.supportedQop() & parseQopList(offered) & m.mechanismConfig.policy.allowedQop()
+	for _, qop := range []byte{QOP_TO_FLAG[AUTH_CONF], QOP_TO_FLAG[AUTH_INT], QOP_TO_FLAG[AUTH]} {
+		if qop&availableQops != 0 {
+			return qop, nil
+		}
+	}
+	return byte(0), newError(m.mechanismConfig.name, ErrQOPNegotiation, "no qop satisfying all the conditions was found")
+}
+
+func (m *DigestMD5Mechanism) Encode(outgoing []byte) ([]byte, error) {
 	return outgoing, nil
 }
 
-func (m *DigestMD5Mechanism) decode(incoming []byte) ([]byte, error) {
+func (m *DigestMD5Mechanism) Decode(incoming []byte) ([]byte, error) {
 	return incoming, nil
 }
 
-func (m *DigestMD5Mechanism) dispose() {
+func (m *DigestMD5Mechanism) Dispose() {
 	m.password = ""
 }
 
-func (m *DigestMD5Mechanism) getConfig() *MechanismConfig {
+func (m *DigestMD5Mechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
+}
+
+// DIGEST_MAX_BUF is the maxbuf advertised by DigestMD5ServerMechanism
+const DIGEST_MAX_BUF = 65536
+
+// DigestMD5ServerMechanism is the server side of the DIGEST-MD5 SASL mechanism. Only the
+// initial authentication with qop "auth" is supported.
+type DigestMD5ServerMechanism struct {
+	mechanismConfig *MechanismConfig
+	service         string
+	host            string
+	secrets         SecretLookup
+	nonce           string
+	nonceCount      int
+	// Realm is the realm offered to the clients and used to compute the digests
+	Realm string
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+	// Random is the source of randomness for the nonce, crypto/rand if nil
+	Random io.Reader
+	// Guard limits the failed attempts, see BruteForceGuard
+	Guard *BruteForceGuard
+	// RemoteAddress is the address of the client, see BruteForceGuard
+	RemoteAddress string
+}
+
+// NewDigestMD5ServerMechanism returns a new DigestMD5ServerMechanism for the service running
+// on host, e.g. "imap" and "elwood.innosoft.com", that looks up the passwords with secrets
+func NewDigestMD5ServerMechanism(service string, host string, realm string, secrets SecretLookup) *DigestMD5ServerMechanism {
+	config := newDefaultConfig("DIGEST-MD5")
+	config.score = 30
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.mutualAuth = true
+	config.qop = QOP{QOP_TO_FLAG[AUTH]}
+	return &DigestMD5ServerMechanism{
+		mechanismConfig: config,
+		service:         service,
+		host:            host,
+		secrets:         secrets,
+		Realm:           realm,
+	}
+}
+
+// Start returns the digest-challenge. DIGEST-MD5 has no initial response.
+func (m *DigestMD5ServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if len(initialResponse) != 0 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "subsequent authentication is not supported")
+	}
+	random := m.Random
+	if random == nil {
+		random = rand.Reader
+	}
+	nonce, err := randSeq(random, 24)
+	if err != nil {
+		return nil, err
+	}
+	m.nonce = nonce
+	challenge := "realm=" + strconv.Quote(m.Realm) + ",nonce=" + strconv.Quote(m.nonce) + ",qop=\"auth\"" +
+		",charset=utf-8,maxbuf=" + strconv.Itoa(DIGEST_MAX_BUF) + ",algorithm=md5-sess"
+	return []byte(challenge), nil
+}
+
+// Step verifies the digest-response and returns the rspauth to send along with the success
+func (m *DigestMD5ServerMechanism) Step(response []byte) ([]byte, error) {
+	if m.nonce == "" {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the challenge hasn't been sent")
+	}
+	c, err := parseChallenge(response)
+	if err != nil {
+		return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrProtocol, Message: "malformed response", Err: err}
+	}
+	for _, key := range []string{"username", "nonce", "cnonce", "nc", "digest-uri", "response"} {
+		if c[key] == "" {
+			return nil, newError(m.mechanismConfig.name, ErrProtocol, "the response has no %s", key)
+		}
+	}
+	username := c["username"]
+	if c["realm"] != m.Realm {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected realm %q", c["realm"])
+	}
+	if c["nonce"] != m.nonce {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the nonce doesn't match the challenge")
+	}
+	if qop := c["qop"]; qop != "" && qop != AUTH {
+		return nil, newError(m.mechanismConfig.name, ErrQOPNegotiation, "qop %q wasn't offered", qop)
+	}
+	nc, err := strconv.ParseUint(c["nc"], 16, 32)
+	if err != nil || len(c["nc"]) != 8 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "invalid nonce count %q", c["nc"])
+	}
+	// Every response to a nonce must increase the nonce count, anything else is a replay
+	if int(nc) != m.nonceCount+1 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected nonce count %d, replayed response", nc)
+	}
+	m.nonceCount = int(nc)
+	if uri := strings.SplitN(c["digest-uri"], "/", 3); len(uri) < 2 || uri[0] != m.service || (m.host != "" && uri[1] != m.host) {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected digest-uri %q", c["digest-uri"])
+	}
+
+	var keyHash string
+	authzid := c["authzid"]
+	err = m.Guard.attempt(m.mechanismConfig.name, username, m.RemoteAddress, func() error {
+		secret, found, err := lookupSecret(m.mechanismConfig, m.secrets, username)
+		if err != nil {
+			return err
+		}
+		keyHash = digestKeyHash(username, m.Realm, secret)
+		expected := digestHash(keyHash, m.nonce, m.nonceCount, c["cnonce"], authzid, AUTH, "AUTHENTICATE:"+c["digest-uri"])
+		if !matchProof([]byte(expected), []byte(strings.ToLower(c["response"])), found) {
+			return newError(m.mechanismConfig.name, ErrBadCredentials, "invalid response for %s", username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(m.mechanismConfig, m.Authorizer, username, authzid); err != nil {
+		return nil, err
+	}
+	m.mechanismConfig.negotiatedQop = QOP_TO_FLAG[AUTH]
+	m.mechanismConfig.complete = true
+	rspauth := digestHash(keyHash, m.nonce, m.nonceCount, c["cnonce"], authzid, AUTH, ":"+c["digest-uri"])
+	return []byte("rspauth=" + rspauth), nil
+}
+
+func (m *DigestMD5ServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *DigestMD5ServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *DigestMD5ServerMechanism) Dispose() {
+	m.nonce = ""
+}
+
+func (m *DigestMD5ServerMechanism) Config() *MechanismConfig {
 	return m.mechanismConfig
 }
 
+// State is the stage of the handshake a Client is in
+type State int
+
+const (
+	// StateNew is the state of a client that hasn't been started
+	StateNew State = iota
+	// StateInProgress is the state of a client between Start and the last Step
+	StateInProgress
+	// StateComplete is the state of a client whose handshake has finished
+	StateComplete
+	// StateFailed is the state of a client whose handshake returned an error
+	StateFailed
+	// StateDisposed is the state of a client after Dispose
+	StateDisposed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateInProgress:
+		return "in progress"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	case StateDisposed:
+		return "disposed"
+	}
+	return "unknown"
+}
+
 // Client is the entry point for usage of this library
 type Client struct {
 	host            string
 	authorizationID string
 	mechanism       Mechanism
+	state           State
+	// err is the error of the first invalid option, returned by Start
+	err error
 }
 
 func newDefaultConfig(name string) *MechanismConfig {
 	return &MechanismConfig{
-		name:               name,
-		score:              0,
-		complete:           false,
-		hasInitialResponse: false,
-		allowsAnonymous:    true,
-		usesPlaintext:      true,
-		activeSafe:         false,
-		dictionarySafe:     false,
-		qop:                nil,
-		AuthorizationID:    "",
+		name:            name,
+		score:           0,
+		complete:        false,
+		allowsAnonymous: true,
+		usesPlaintext:   true,
+		activeSafe:      false,
+		dictionarySafe:  false,
+		qop:             nil,
+		AuthorizationID: "",
 	}
 }
 
-// NewSaslClient creates a new client given a host and a mechanism
-func NewSaslClient(host string, mechanism Mechanism) *Client {
+// NewSaslClient creates a new client given a host, a mechanism and options, e.g.
+// NewSaslClient(host, mechanism, WithAuthorizationID("user"), WithQOP(AUTH_CONF)). An
+// invalid option makes Start fail, NewSaslClientWithOptions reports it right away.
+func NewSaslClient(host string, mechanism Mechanism, opts ...Option) *Client {
 	mech, ok := mechanism.(*GSSAPIMechanism)
 	if ok {
 		mech.host = host
@@ -387,43 +1051,186 @@ func NewSaslClient(host string, mechanism Mechanism) *Client {
 	if ok {
 		mechDigest.host = host
 	}
-	return &Client{
+	client := &Client{
 		host:      host,
 		mechanism: mechanism,
 	}
+	for _, opt := range opts {
+		if err := opt(client); err != nil {
+			client.err = err
+			break
+		}
+	}
+	return client
 }
 
-// Start initializes the client and may generate the first challenge
+// Start initializes the client and may generate the first challenge. It can only be
+// called once.
 func (client *Client) Start() ([]byte, error) {
-	return client.mechanism.start()
+	if client.state != StateNew {
+		return nil, &StateError{Op: "Start", State: client.state}
+	}
+	if client.err != nil {
+		client.state = StateFailed
+		return nil, client.err
+	}
+	client.state = StateInProgress
+	response, err := client.mechanism.Start()
+	if err == nil {
+		err = client.checkPolicy()
+	}
+	if err != nil {
+		client.state = StateFailed
+		return nil, err
+	}
+	// A mechanism that completes with its initial response, like PLAIN, stays in progress:
+	// protocols without initial responses send it in reply to the first, empty, challenge.
+	return response, nil
 }
 
-// Step is used for the initial handshake
+// Step is used for the initial handshake. It fails once the handshake has completed
+// or failed.
 func (client *Client) Step(challenge []byte) ([]byte, error) {
-	return client.mechanism.step(challenge)
+	if client.state != StateInProgress {
+		return nil, &StateError{Op: "Step", State: client.state}
+	}
+	response, err := client.mechanism.Step(challenge)
+	if err == nil {
+		err = client.checkPolicy()
+	}
+	if err != nil {
+		client.state = StateFailed
+		return nil, err
+	}
+	if client.mechanism.Config().complete {
+		client.state = StateComplete
+	}
+	return response, nil
+}
+
+// State returns the stage of the handshake the client is in
+func (client *Client) State() State {
+	return client.state
+}
+
+// Session describes the outcome of a completed handshake
+type Session struct {
+	// Mechanism is the SASL name of the mechanism that ran
+	Mechanism string
+	// AuthenticatedIdentity is the identity whose credentials were verified
+	AuthenticatedIdentity string
+	// AuthorizationID is the identity the client acts as
+	AuthorizationID string
+	// QOP is the negotiated quality of protection, e.g. "auth-conf"
+	QOP string
+	// SSF is the security strength factor of the negotiated QOP
+	SSF int
+	// MaxBuffer is the max buffer size the client accepts, 0 when there is no security layer
+	MaxBuffer int
+	// PeerMaxBuffer is the max buffer size the server accepts, 0 when there is no security layer
+	PeerMaxBuffer int
+}
+
+// Session returns the parameters negotiated during the handshake. It can only be called
+// once the handshake has completed.
+func (client *Client) Session() (Session, error) {
+	if err := client.secured("Session"); err != nil {
+		return Session{}, err
+	}
+	return newSession(client.mechanism.Config()), nil
+}
+
+func newSession(config *MechanismConfig) Session {
+	qop := config.negotiatedQop
+	if qop == 0 {
+		qop = QOP_TO_FLAG[AUTH]
+	}
+	authorizationID := config.AuthorizationID
+	if authorizationID == "" {
+		authorizationID = config.identity
+	}
+	return Session{
+		Mechanism:             config.name,
+		AuthenticatedIdentity: config.identity,
+		AuthorizationID:       authorizationID,
+		QOP:                   qopName(qop),
+		SSF:                   SSF(qop),
+		MaxBuffer:             config.maxBuffer,
+		PeerMaxBuffer:         config.peerMaxBuffer,
+	}
+}
+
+// finish marks the handshake as completed once the server has reported success
+func (client *Client) finish() {
+	if client.state == StateInProgress && client.mechanism.Config().complete {
+		client.state = StateComplete
+	}
 }
 
-// Complete returns true if the handshake has ended
+// secured returns an error if the security layer can't be used yet, or anymore
+func (client *Client) secured(op string) error {
+	if !client.Complete() {
+		return &StateError{Op: op, State: client.state}
+	}
+	return nil
+}
+
+// checkPolicy verifies the outcome of the handshake against the security policy once
+// the mechanism has completed
+func (client *Client) checkPolicy() error {
+	config := client.mechanism.Config()
+	if !config.complete || config.policy == nil {
+		return nil
+	}
+	return config.policy.checkNegotiated(config)
+}
+
+// SetSecurityPolicy restricts the client to the given policy. It returns an error if the
+// mechanism can't satisfy it, in which case the handshake shouldn't be started.
+func (client *Client) SetSecurityPolicy(policy SecurityPolicy) error {
+	if client.state != StateNew {
+		return &StateError{Op: "SetSecurityPolicy", State: client.state}
+	}
+	config := client.mechanism.Config()
+	if err := policy.check(config); err != nil {
+		return err
+	}
+	config.policy = &policy
+	return nil
+}
+
+// Complete returns true if the handshake has ended successfully. It is false once the
+// handshake has failed, even if the mechanism had computed its last response.
 func (client *Client) Complete() bool {
-	return client.mechanism.getConfig().complete
+	return client.state == StateComplete || client.state == StateInProgress && client.mechanism.Config().complete
 }
 
 // GetConfig returns the configuration of the mechanism
 func (client *Client) GetConfig() *MechanismConfig {
-	return client.mechanism.getConfig()
+	return client.mechanism.Config()
 }
 
 // Encode is applied on the outgoing bytes to secure them usually
 func (client *Client) Encode(outgoing []byte) ([]byte, error) {
-	return client.mechanism.encode(outgoing)
+	if err := client.secured("Encode"); err != nil {
+		return nil, err
+	}
+	return client.mechanism.Encode(outgoing)
 }
 
 // Decode is used on the incoming data to produce the usable bytes
 func (client *Client) Decode(incoming []byte) ([]byte, error) {
-	return client.mechanism.decode(incoming)
+	if err := client.secured("Decode"); err != nil {
+		return nil, err
+	}
+	return client.mechanism.Decode(incoming)
 }
 
 // Dispose eliminates sensitive information
 func (client *Client) Dispose() {
-	client.mechanism.dispose()
+	if client.state == StateDisposed {
+		return
+	}
+	client.state = StateDisposed
+	client.mechanism.Dispose()
 }
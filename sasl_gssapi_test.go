@@ -3,7 +3,10 @@
 package gosasl
 
 import (
+	"os"
 	"testing"
+
+	"github.com/beltran/gssapi"
 )
 
 func TestGSSAPIMechanism(t *testing.T) {
@@ -26,3 +29,46 @@ func TestGSSAPIMechanism(t *testing.T) {
 
 	client.Dispose()
 }
+
+// TestGSSAPIServerMechanismWithoutMutualAuth needs a KDC: the keytab of the service
+// principal in GOSASL_TEST_KEYTAB, the principal in GOSASL_TEST_PRINCIPAL and a ticket for
+// the client in the credential cache
+func TestGSSAPIServerMechanismWithoutMutualAuth(t *testing.T) {
+	keytab, principal := os.Getenv("GOSASL_TEST_KEYTAB"), os.Getenv("GOSASL_TEST_PRINCIPAL")
+	if keytab == "" || principal == "" {
+		t.Skip("GOSASL_TEST_KEYTAB and GOSASL_TEST_PRINCIPAL aren't set")
+	}
+	mechanism, err := NewGSSAPIServerMechanism(principal, keytab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mechanism.Dispose()
+	context, err := newGSSAPIContext(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.dispose()
+	context.reqFlags &^= uint32(gssapi.GSS_C_MUTUAL_FLAG)
+	if err := initClientContext(context, principal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context is established with a single token, the server offers the security
+	// layers right away instead of waiting for an empty response
+	server := NewSaslServer(mechanism)
+	challenge, err := server.Start(context.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := context.unwrap(challenge)
+	if err != nil || len(offer) != 4 {
+		t.Fatalf("Expected the wrapped security layer offer, got %x: %v", challenge, err)
+	}
+	response, err := context.wrap([]byte{QOP_TO_FLAG[AUTH], 0, 0, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Step(response); err != nil || !server.Complete() {
+		t.Fatalf("The server should be complete: %v", err)
+	}
+}
@@ -3,6 +3,7 @@
 package gosasl
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -59,18 +60,18 @@ func TestPlainMechanismWithAuthorizationId(t *testing.T) {
 }
 
 func TestCramMD5Mechanism(t *testing.T) {
-	mechanism := NewCramMD5Mechanism("user", "pass")
+	// Example from RFC 2195
+	mechanism := NewCramMD5Mechanism("tim", "tanstaaftanstaaf")
 	client := NewSaslClient("localhost", mechanism)
 	client.Start()
-	response, _ := client.Step([]byte("msg"))
+	response, _ := client.Step([]byte("<1896.697170952@postoffice.reston.mci.net>"))
 	if !client.Complete() {
 		t.Fatal("Challenge should have completed")
 	}
 
-	var expected = []byte{117, 115, 101, 114, 32, 182, 240, 88, 240, 136, 183, 51, 193, 125, 1, 166, 33, 169, 193, 157, 192}
-
-	if !reflect.DeepEqual(response, expected) {
-		t.Fatalf("Response expected was %x, but got %x", expected, response)
+	expected := "tim b913a602c7eda7a495b4e6e7334d3890"
+	if string(response) != expected {
+		t.Fatalf("Response expected was %q, but got %q", expected, response)
 	}
 
 	client.Dispose()
@@ -109,8 +110,12 @@ func TestDigestMD5Mechanism(t *testing.T) {
 		t.Fatalf("Response expected was %s, but got %s", expectedMap, actualMap)
 	}
 
-	serverResponse := []byte("rspauth=ea40f60335c427b5527b84dbabcdfffd")
-	response, err = client.Step([]byte(serverResponse))
+	keyHash := digestKeyHash("chris", "elwood.innosoft.com", "secret")
+	rspauth := digestHash(keyHash, "OA6MG9tEQGm2hh", 1, mechanism.cnonce, "", "auth", ":imap/elwood.innosoft.com")
+	response, err = client.Step([]byte("rspauth=" + rspauth))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !client.Complete() {
 		t.Fatal("Challenge should have completed")
 	}
@@ -120,3 +125,45 @@ func TestDigestMD5Mechanism(t *testing.T) {
 
 	client.Dispose()
 }
+
+func TestCustomMechanism(t *testing.T) {
+	mechanism := &reverseMechanism{config: NewMechanismConfig("X-REVERSE")}
+	client := NewSaslClient("localhost", mechanism)
+	client.Start()
+	response, err := client.Step([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.Complete() {
+		t.Fatal("Challenge should have completed")
+	}
+	if !reflect.DeepEqual(response, []byte("dcba")) {
+		t.Fatalf("Unexpected response from client.Step: %s", response)
+	}
+	if client.GetConfig().Name() != "X-REVERSE" {
+		t.Fatalf("Unexpected mechanism name: %s", client.GetConfig().Name())
+	}
+	client.Dispose()
+}
+
+func TestGSSAPIMechanismWithoutKerberos(t *testing.T) {
+	_, err := NewGSSAPIMechanism("hive")
+	if !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("Expected ErrUnsupportedMechanism, got %v", err)
+	}
+	_, err = NewGSSAPIServerMechanism("hive/localhost", "")
+	if !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("Expected ErrUnsupportedMechanism, got %v", err)
+	}
+
+	client, err := NewSaslClientWithOptions("localhost", &GSSAPIMechanism{}, WithAuthorizationID("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.GetConfig().AuthorizationID != "user" {
+		t.Fatal("WithAuthorizationID should be kept by the stub")
+	}
+	if _, err := client.Start(); !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("Expected ErrUnsupportedMechanism, got %v", err)
+	}
+}
@@ -0,0 +1,723 @@
+package gosasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ScramMechanism corresponds to the SCRAM family of SASL mechanisms, see RFC 5802 and
+// RFC 7677. SASLprep isn't applied to the username and the password, they are used as is.
+type ScramMechanism struct {
+	mechanismConfig *MechanismConfig
+	hash            func() hash.Hash
+	plus            bool
+	username        string
+	password        string
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	channelBinding  []byte
+	serverSignature []byte
+	// TLS is the connection the mechanism runs on, if any. The -PLUS variants bind the
+	// authentication to it. The others tell the server that the client supports channel
+	// binding, so that a server offering the -PLUS variants detects a downgrade.
+	TLS *tls.ConnectionState
+	// ChannelBindingType is the channel binding of the -PLUS variants, tls-exporter for
+	// TLS 1.3 and tls-unique before if empty
+	ChannelBindingType string
+	// MinIterations is the lowest iteration count accepted from the server,
+	// DefaultScramMinIterations if zero. Set it to 1 for servers using weaker counts.
+	MinIterations int
+	// MaxIterations is the highest iteration count accepted from the server,
+	// DefaultScramMaxIterations if zero, so that a hostile server can't keep the client
+	// busy hashing
+	MaxIterations int
+}
+
+const (
+	// DefaultScramMinIterations is the minimum iteration count recommended by RFC 7677
+	DefaultScramMinIterations = 4096
+	// DefaultScramMaxIterations is the default limit of the iteration count
+	DefaultScramMaxIterations = 1000000
+)
+
+// NewScramSHA1Mechanism returns a new ScramMechanism for SCRAM-SHA-1
+func NewScramSHA1Mechanism(username string, password string) *ScramMechanism {
+	return newScramMechanism("SCRAM-SHA-1", 40, sha1.New, username, password)
+}
+
+// NewScramSHA256Mechanism returns a new ScramMechanism for SCRAM-SHA-256
+func NewScramSHA256Mechanism(username string, password string) *ScramMechanism {
+	return newScramMechanism("SCRAM-SHA-256", 45, sha256.New, username, password)
+}
+
+// NewScramSHA512Mechanism returns a new ScramMechanism for SCRAM-SHA-512
+func NewScramSHA512Mechanism(username string, password string) *ScramMechanism {
+	return newScramMechanism("SCRAM-SHA-512", 50, sha512.New, username, password)
+}
+
+// NewScramSHA1PlusMechanism returns a new ScramMechanism for SCRAM-SHA-1-PLUS, bound to
+// the TLS connection
+func NewScramSHA1PlusMechanism(username string, password string, state tls.ConnectionState) *ScramMechanism {
+	return newScramPlusMechanism(NewScramSHA1Mechanism(username, password), &state)
+}
+
+// NewScramSHA256PlusMechanism returns a new ScramMechanism for SCRAM-SHA-256-PLUS, bound to
+// the TLS connection
+func NewScramSHA256PlusMechanism(username string, password string, state tls.ConnectionState) *ScramMechanism {
+	return newScramPlusMechanism(NewScramSHA256Mechanism(username, password), &state)
+}
+
+// NewScramSHA512PlusMechanism returns a new ScramMechanism for SCRAM-SHA-512-PLUS, bound to
+// the TLS connection
+func NewScramSHA512PlusMechanism(username string, password string, state tls.ConnectionState) *ScramMechanism {
+	return newScramPlusMechanism(NewScramSHA512Mechanism(username, password), &state)
+}
+
+func newScramPlusMechanism(m *ScramMechanism, state *tls.ConnectionState) *ScramMechanism {
+	m.mechanismConfig.name += "-PLUS"
+	m.mechanismConfig.score++
+	m.mechanismConfig.channelBinding = true
+	m.plus = true
+	m.TLS = state
+	return m
+}
+
+func newScramMechanism(name string, score int, hash func() hash.Hash, username string, password string) *ScramMechanism {
+	return &ScramMechanism{
+		mechanismConfig: newScramConfig(name, score),
+		hash:            hash,
+		username:        username,
+		password:        password,
+	}
+}
+
+// newScramConfig returns the configuration shared by both sides of the SCRAM mechanisms
+func newScramConfig(name string, score int) *MechanismConfig {
+	config := newDefaultConfig(name)
+	config.score = score
+	config.allowsAnonymous = false
+	config.usesPlaintext = false
+	config.activeSafe = true
+	config.mutualAuth = true
+	return config
+}
+
+func (m *ScramMechanism) Start() ([]byte, error) {
+	return m.Step(nil)
+}
+
+// resolveCredentials asks the callback handler for the credentials that weren't given
+func (m *ScramMechanism) resolveCredentials() error {
+	pending := &pendingCallbacks{}
+	pending.add(&m.username, &Callback{ID: CallbackUsername, Prompt: "Username"})
+	pending.add(&m.password, &Callback{ID: CallbackPassword, Prompt: "Password"})
+	pending.add(&m.mechanismConfig.AuthorizationID, &Callback{ID: CallbackAuthorizationID, Prompt: "Authorization ID"})
+	if err := m.mechanismConfig.interact(pending); err != nil {
+		return err
+	}
+	if m.username == "" {
+		return newError(m.mechanismConfig.name, ErrMissingCredentials, "no username was provided")
+	}
+	return nil
+}
+
+// gs2Header returns the GS2 header of the client first message
+func (m *ScramMechanism) gs2Header() string {
+	header := "n,"
+	if m.plus {
+		header = "p=" + m.ChannelBindingType + ","
+	} else if m.TLS != nil {
+		header = "y,"
+	}
+	if m.mechanismConfig.AuthorizationID != "" {
+		header += "a=" + encodeSaslName(m.mechanismConfig.AuthorizationID)
+	}
+	return header + ","
+}
+
+func (m *ScramMechanism) Step(challenge []byte) ([]byte, error) {
+	switch m.step {
+	case 0:
+		if err := m.resolveCredentials(); err != nil {
+			return nil, err
+		}
+		if m.plus {
+			if m.ChannelBindingType == "" && m.TLS != nil {
+				m.ChannelBindingType = defaultChannelBinding(m.TLS)
+			}
+			data, err := ChannelBinding(m.TLS, m.ChannelBindingType)
+			if err != nil {
+				return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrInvalidOption, Message: "the channel binding data can't be computed", Err: err}
+			}
+			m.channelBinding = data
+		}
+		if m.clientNonce == "" {
+			nonce, err := randSeq(m.mechanismConfig.random(), 24)
+			if err != nil {
+				return nil, err
+			}
+			m.clientNonce = nonce
+		}
+		m.clientFirstBare = "n=" + encodeSaslName(m.username) + ",r=" + m.clientNonce
+		m.step = 1
+		return []byte(m.gs2Header() + m.clientFirstBare), nil
+
+	case 1:
+		response, err := m.clientFinal(string(challenge))
+		if err != nil {
+			return nil, err
+		}
+		m.step = 2
+		return response, nil
+
+	case 2:
+		attributes, err := parseScramAttributes(m.mechanismConfig.name, string(challenge))
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := attributes["e"]; ok {
+			return nil, &ScramError{Mechanism: m.mechanismConfig.name, Value: value}
+		}
+		verifier, err := base64.StdEncoding.DecodeString(attributes["v"])
+		if err != nil || len(verifier) == 0 {
+			return nil, newError(m.mechanismConfig.name, ErrProtocol, "the server final message has no valid verifier")
+		}
+		m.step = 3
+		if !hmac.Equal(verifier, m.serverSignature) {
+			return nil, newError(m.mechanismConfig.name, ErrServerAuthentication, "the server signature doesn't match")
+		}
+		m.mechanismConfig.complete = true
+		m.mechanismConfig.identity = m.username
+		return nil, nil
+	}
+	return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected step after the negotiation")
+}
+
+// clientFinal computes the client final message, with the proof, from the server first
+// message
+func (m *ScramMechanism) clientFinal(serverFirst string) ([]byte, error) {
+	attributes, err := parseScramAttributes(m.mechanismConfig.name, serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := attributes["e"]; ok {
+		return nil, &ScramError{Mechanism: m.mechanismConfig.name, Value: value}
+	}
+	if _, ok := attributes["m"]; ok {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "mandatory extensions aren't supported")
+	}
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, m.clientNonce) || len(nonce) == len(m.clientNonce) {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the server nonce doesn't extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the server first message has no valid salt")
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "invalid iteration count %q", attributes["i"])
+	}
+	minIterations, maxIterations := m.MinIterations, m.MaxIterations
+	if minIterations == 0 {
+		minIterations = DefaultScramMinIterations
+	}
+	if maxIterations == 0 {
+		maxIterations = DefaultScramMaxIterations
+	}
+	if iterations < minIterations || iterations > maxIterations {
+		return nil, newError(m.mechanismConfig.name, ErrSecurityPolicy, "the iteration count %d isn't between %d and %d", iterations, minIterations, maxIterations)
+	}
+
+	// The channel binding data is only sent with the p flag, it is nil otherwise
+	cbindInput := append([]byte(m.gs2Header()), m.channelBinding...)
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString(cbindInput) + ",r=" + nonce
+	authMessage := m.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	keys := newScramKeys(m.hash, m.password, salt, iterations)
+	clientSignature := scramHMAC(m.hash, keys.storedKey, authMessage)
+	proof := make([]byte, len(keys.clientKey))
+	for i := range proof {
+		proof[i] = keys.clientKey[i] ^ clientSignature[i]
+	}
+	m.serverSignature = scramHMAC(m.hash, keys.serverKey, authMessage)
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *ScramMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *ScramMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *ScramMechanism) Dispose() {
+	m.password = ""
+	m.serverSignature = nil
+}
+
+func (m *ScramMechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
+}
+
+// ScramCredentials are what a SCRAM server stores for a user instead of the password, see
+// RFC 5802 section 3. NewScramCredentials derives them from the password.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the credentials of a password for the given SCRAM mechanism,
+// e.g. "SCRAM-SHA-256", to provision the store of a ScramServerMechanism
+func NewScramCredentials(mechanism string, password string, salt []byte, iterations int) (ScramCredentials, error) {
+	hash, ok := scramHashes[scramBaseName(mechanism)]
+	if !ok {
+		return ScramCredentials{}, newError(mechanism, ErrUnsupportedMechanism, "not a SCRAM mechanism")
+	}
+	if len(salt) == 0 || iterations <= 0 {
+		return ScramCredentials{}, newError(mechanism, ErrInvalidOption, "a salt and a positive iteration count are required")
+	}
+	keys := newScramKeys(hash, password, salt, iterations)
+	return ScramCredentials{
+		Salt:       append([]byte(nil), salt...),
+		Iterations: iterations,
+		StoredKey:  keys.storedKey,
+		ServerKey:  keys.serverKey,
+	}, nil
+}
+
+var scramHashes = map[string]func() hash.Hash{
+	"SCRAM-SHA-1":   sha1.New,
+	"SCRAM-SHA-256": sha256.New,
+	"SCRAM-SHA-512": sha512.New,
+}
+
+// scramBaseName returns the name of the mechanism without the -PLUS suffix, the PLUS
+// variants use the same credentials
+func scramBaseName(mechanism string) string {
+	return strings.TrimSuffix(strings.ToUpper(mechanism), "-PLUS")
+}
+
+// ScramCredentialStore returns the stored SCRAM credentials of a user for the server side
+// of the SCRAM mechanisms
+type ScramCredentialStore interface {
+	// LookupScramCredentials returns the credentials of username for mechanism, e.g.
+	// "SCRAM-SHA-256" for both SCRAM-SHA-256 and SCRAM-SHA-256-PLUS. It returns found as
+	// false if the user doesn't exist. Errors are reserved for failures to look it up.
+	LookupScramCredentials(mechanism string, username string) (credentials ScramCredentials, found bool, err error)
+}
+
+// ScramCredentialStoreFunc adapts a function to the ScramCredentialStore interface
+type ScramCredentialStoreFunc func(mechanism string, username string) (ScramCredentials, bool, error)
+
+// LookupScramCredentials calls f(mechanism, username)
+func (f ScramCredentialStoreFunc) LookupScramCredentials(mechanism string, username string) (ScramCredentials, bool, error) {
+	return f(mechanism, username)
+}
+
+// ScramServerMechanism is the server side of the SCRAM mechanisms. It never sees the
+// password, only the credentials stored for the user. Unknown users go through the whole
+// exchange with made up credentials and are rejected like a wrong password.
+type ScramServerMechanism struct {
+	mechanismConfig *MechanismConfig
+	hash            func() hash.Hash
+	store           ScramCredentialStore
+	plus            bool
+	step            int
+	header          gs2Header
+	username        string
+	nonce           string
+	// serverNonce is the part of the nonce added by the server, drawn from Random
+	serverNonce     string
+	clientFirstBare string
+	serverFirst     string
+	credentials     ScramCredentials
+	found           bool
+	channelBinding  []byte
+	// rejection is the server-error-value detected in the client first message, sent in
+	// the server final message
+	rejection string
+	// failure is the reason of the rejection once the server final message has been sent
+	failure error
+	// TLS is the connection the mechanism runs on. The -PLUS variants check the channel
+	// binding against it. Set it on the others when the -PLUS variants are offered too, so
+	// that a client saying it could have used channel binding is rejected as a downgrade.
+	TLS *tls.ConnectionState
+	// Certificate is the certificate the server presents, tls-server-end-point can't be
+	// checked without it
+	Certificate *x509.Certificate
+	// Authorizer decides on the authorization ids, see Authorizer
+	Authorizer Authorizer
+	// Guard limits the failed attempts, see BruteForceGuard
+	Guard *BruteForceGuard
+	// RemoteAddress is the address of the client, see BruteForceGuard
+	RemoteAddress string
+	// Random is the source of randomness for the nonce, crypto/rand if nil
+	Random io.Reader
+	// Iterations is the iteration count sent for unknown users, DefaultScramMinIterations
+	// if 0. It should be the one the credentials of the store are created with, otherwise
+	// the count tells which users exist.
+	Iterations int
+}
+
+// NewScramSHA1ServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-1
+func NewScramSHA1ServerMechanism(store ScramCredentialStore) *ScramServerMechanism {
+	return newScramServerMechanism("SCRAM-SHA-1", 40, sha1.New, store)
+}
+
+// NewScramSHA256ServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-256
+func NewScramSHA256ServerMechanism(store ScramCredentialStore) *ScramServerMechanism {
+	return newScramServerMechanism("SCRAM-SHA-256", 45, sha256.New, store)
+}
+
+// NewScramSHA512ServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-512
+func NewScramSHA512ServerMechanism(store ScramCredentialStore) *ScramServerMechanism {
+	return newScramServerMechanism("SCRAM-SHA-512", 50, sha512.New, store)
+}
+
+// NewScramSHA1PlusServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-1-PLUS on
+// the TLS connection
+func NewScramSHA1PlusServerMechanism(store ScramCredentialStore, state tls.ConnectionState) *ScramServerMechanism {
+	return newScramPlusServerMechanism(NewScramSHA1ServerMechanism(store), &state)
+}
+
+// NewScramSHA256PlusServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-256-PLUS
+// on the TLS connection
+func NewScramSHA256PlusServerMechanism(store ScramCredentialStore, state tls.ConnectionState) *ScramServerMechanism {
+	return newScramPlusServerMechanism(NewScramSHA256ServerMechanism(store), &state)
+}
+
+// NewScramSHA512PlusServerMechanism returns a new ScramServerMechanism for SCRAM-SHA-512-PLUS
+// on the TLS connection
+func NewScramSHA512PlusServerMechanism(store ScramCredentialStore, state tls.ConnectionState) *ScramServerMechanism {
+	return newScramPlusServerMechanism(NewScramSHA512ServerMechanism(store), &state)
+}
+
+func newScramServerMechanism(name string, score int, hash func() hash.Hash, store ScramCredentialStore) *ScramServerMechanism {
+	return &ScramServerMechanism{
+		mechanismConfig: newScramConfig(name, score),
+		hash:            hash,
+		store:           store,
+	}
+}
+
+func newScramPlusServerMechanism(m *ScramServerMechanism, state *tls.ConnectionState) *ScramServerMechanism {
+	m.mechanismConfig.name += "-PLUS"
+	m.mechanismConfig.score++
+	m.mechanismConfig.channelBinding = true
+	m.plus = true
+	m.TLS = state
+	return m
+}
+
+// Start processes the client first message, clients that don't send it as the initial
+// response get an empty challenge
+func (m *ScramServerMechanism) Start(initialResponse []byte) ([]byte, error) {
+	if initialResponse == nil {
+		return []byte{}, nil
+	}
+	return m.Step(initialResponse)
+}
+
+// Step answers the client first message with the salt and the iteration count, then checks
+// the proof of the client final message. A rejected proof or channel binding is answered
+// with an e= server final message, the authentication fails once the client acknowledges
+// it.
+func (m *ScramServerMechanism) Step(response []byte) ([]byte, error) {
+	switch m.step {
+	case 0:
+		serverFirst, err := m.serverFirstMessage(string(response))
+		if err != nil {
+			return nil, err
+		}
+		m.step = 1
+		return []byte(serverFirst), nil
+
+	case 1:
+		m.step = 2
+		return m.serverFinalMessage(string(response))
+
+	case 2:
+		if m.failure != nil {
+			if len(response) != 0 {
+				return nil, newError(m.mechanismConfig.name, ErrProtocol, "the server error should be acknowledged with an empty response")
+			}
+			return nil, m.failure
+		}
+	}
+	return nil, newError(m.mechanismConfig.name, ErrProtocol, "unexpected step after the negotiation")
+}
+
+// serverFirstMessage parses the client first message and looks up the credentials of the
+// user
+func (m *ScramServerMechanism) serverFirstMessage(clientFirst string) (string, error) {
+	if !utf8.ValidString(clientFirst) {
+		return "", newError(m.mechanismConfig.name, ErrProtocol, "the client first message isn't valid UTF-8")
+	}
+	header, bare, err := parseGS2Header(m.mechanismConfig.name, clientFirst)
+	if err != nil {
+		return "", err
+	}
+	m.header = header
+	if err := m.checkChannelBinding(); err != nil {
+		return "", err
+	}
+	attributes, err := parseScramAttributes(m.mechanismConfig.name, bare)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := attributes["m"]; ok {
+		m.rejection = "extensions-not-supported"
+	}
+	if attributes["n"] == "" || attributes["r"] == "" {
+		return "", newError(m.mechanismConfig.name, ErrProtocol, "the client first message needs a username and a nonce")
+	}
+	m.username, err = decodeSaslName(m.mechanismConfig.name, attributes["n"])
+	if err != nil {
+		return "", err
+	}
+
+	m.credentials, m.found, err = m.store.LookupScramCredentials(scramBaseName(m.mechanismConfig.name), m.username)
+	if err != nil {
+		return "", &Error{Mechanism: m.mechanismConfig.name, Kind: ErrVerifier, Message: "the credentials can't be looked up", Err: err}
+	}
+	if !m.found {
+		iterations := m.Iterations
+		if iterations == 0 {
+			iterations = DefaultScramMinIterations
+		}
+		m.credentials = fakeScramCredentials(m.hash, m.username, iterations)
+	}
+	if len(m.credentials.Salt) == 0 || m.credentials.Iterations <= 0 {
+		return "", newError(m.mechanismConfig.name, ErrVerifier, "the credentials of %s are incomplete", m.username)
+	}
+	if m.serverNonce == "" {
+		random := m.Random
+		if random == nil {
+			random = rand.Reader
+		}
+		nonce, err := randSeq(random, 24)
+		if err != nil {
+			return "", err
+		}
+		m.serverNonce = nonce
+	}
+	m.nonce = attributes["r"] + m.serverNonce
+	m.clientFirstBare = bare
+	m.serverFirst = "r=" + m.nonce + ",s=" + base64.StdEncoding.EncodeToString(m.credentials.Salt) +
+		",i=" + strconv.Itoa(m.credentials.Iterations)
+	return m.serverFirst, nil
+}
+
+// checkChannelBinding checks the channel binding flag of the client against the variant
+// of the mechanism and computes the binding data the client should send
+func (m *ScramServerMechanism) checkChannelBinding() error {
+	switch m.header.cbindFlag {
+	case "p":
+		if !m.plus {
+			return newError(m.mechanismConfig.name, ErrProtocol, "channel binding is only used by the -PLUS variants")
+		}
+		var data []byte
+		var err error
+		if m.header.cbindName == ChannelBindingTLSServerEndPoint {
+			if m.Certificate == nil {
+				m.rejection = "unsupported-channel-binding-type"
+				return nil
+			}
+			data, err = TLSServerEndPoint(m.Certificate)
+		} else {
+			data, err = ChannelBinding(m.TLS, m.header.cbindName)
+		}
+		if err != nil {
+			m.rejection = "unsupported-channel-binding-type"
+			return nil
+		}
+		m.channelBinding = data
+	default:
+		if m.plus {
+			return newError(m.mechanismConfig.name, ErrProtocol, "the -PLUS variants require channel binding")
+		}
+		if m.header.cbindFlag == "y" && m.TLS != nil {
+			// The client could have bound the authentication to the connection but didn't
+			// see the -PLUS variants, they may have been stripped by an attacker
+			m.rejection = "server-does-support-channel-binding"
+		}
+	}
+	return nil
+}
+
+// serverFinalMessage checks the client final message and returns the server signature or
+// the server error
+func (m *ScramServerMechanism) serverFinalMessage(clientFinal string) ([]byte, error) {
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the client final message has no proof")
+	}
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+	attributes, err := parseScramAttributes(m.mechanismConfig.name, clientFinalWithoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attributes["r"] != m.nonce {
+		return nil, newError(m.mechanismConfig.name, ErrProtocol, "the nonce doesn't match")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+3:])
+	if err != nil {
+		return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrProtocol, Message: "the proof isn't base64", Err: err}
+	}
+	cbindInput, err := base64.StdEncoding.DecodeString(attributes["c"])
+	if err != nil {
+		return nil, &Error{Mechanism: m.mechanismConfig.name, Kind: ErrProtocol, Message: "the channel binding isn't base64", Err: err}
+	}
+	if m.rejection == "" && !hmac.Equal(cbindInput, append([]byte(m.header.raw), m.channelBinding...)) {
+		m.rejection = "channel-bindings-dont-match"
+	}
+	if m.rejection != "" {
+		return m.reject(&ScramError{Mechanism: m.mechanismConfig.name, Value: m.rejection})
+	}
+
+	authMessage := m.clientFirstBare + "," + m.serverFirst + "," + clientFinalWithoutProof
+	err = m.Guard.attempt(m.mechanismConfig.name, m.username, m.RemoteAddress, func() error {
+		clientSignature := scramHMAC(m.hash, m.credentials.StoredKey, authMessage)
+		if len(proof) != len(clientSignature) {
+			return &ScramError{Mechanism: m.mechanismConfig.name, Value: "invalid-proof"}
+		}
+		clientKey := make([]byte, len(proof))
+		for i := range clientKey {
+			clientKey[i] = proof[i] ^ clientSignature[i]
+		}
+		storedKey := m.hash()
+		storedKey.Write(clientKey)
+		if !matchProof(m.credentials.StoredKey, storedKey.Sum(nil), m.found) {
+			return &ScramError{Mechanism: m.mechanismConfig.name, Value: "invalid-proof"}
+		}
+		return nil
+	})
+	if err == nil {
+		err = authorize(m.mechanismConfig, m.Authorizer, m.username, m.header.authorizationID)
+	}
+	if err != nil {
+		return m.reject(err)
+	}
+	m.mechanismConfig.complete = true
+	serverSignature := scramHMAC(m.hash, m.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// reject records the reason of the failure and returns the matching server final message
+func (m *ScramServerMechanism) reject(err error) ([]byte, error) {
+	m.failure = err
+	value := "other-error"
+	var scramErr *ScramError
+	if errors.As(err, &scramErr) {
+		value = scramErr.Value
+	}
+	return []byte("e=" + value), nil
+}
+
+func (m *ScramServerMechanism) Encode(outgoing []byte) ([]byte, error) {
+	return outgoing, nil
+}
+
+func (m *ScramServerMechanism) Decode(incoming []byte) ([]byte, error) {
+	return incoming, nil
+}
+
+func (m *ScramServerMechanism) Dispose() {
+	m.credentials = ScramCredentials{}
+}
+
+func (m *ScramServerMechanism) Config() *MechanismConfig {
+	return m.mechanismConfig
+}
+
+// fakeScramCredentials returns the credentials of a user that doesn't exist, see fakeSecret
+func fakeScramCredentials(hash func() hash.Hash, username string, iterations int) ScramCredentials {
+	secret := fakeSecret(username)
+	return ScramCredentials{
+		Salt:       secret[:16],
+		Iterations: iterations,
+		StoredKey:  scramHMAC(hash, secret, "Stored Key"),
+		ServerKey:  scramHMAC(hash, secret, "Server Key"),
+	}
+}
+
+// scramKeys are the keys derived from the password, see RFC 5802 section 3
+type scramKeys struct {
+	clientKey []byte
+	storedKey []byte
+	serverKey []byte
+}
+
+func newScramKeys(hash func() hash.Hash, password string, salt []byte, iterations int) scramKeys {
+	saltedPassword := pbkdf2(hash, []byte(password), salt, iterations, hash().Size())
+	clientKey := scramHMAC(hash, saltedPassword, "Client Key")
+	storedKey := hash()
+	storedKey.Write(clientKey)
+	return scramKeys{
+		clientKey: clientKey,
+		storedKey: storedKey.Sum(nil),
+		serverKey: scramHMAC(hash, saltedPassword, "Server Key"),
+	}
+}
+
+func scramHMAC(hash func() hash.Hash, key []byte, message string) []byte {
+	mac := hmac.New(hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key of keyLength bytes from the password, see RFC 8018 section 5.2.
+// SCRAM calls it Hi with a key as long as the hash.
+func pbkdf2(hash func() hash.Hash, password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(hash, password)
+	size := prf.Size()
+	key := make([]byte, 0, (keyLength+size-1)/size*size)
+	counter := make([]byte, 4)
+	for block := uint32(1); len(key) < keyLength; block++ {
+		binary.BigEndian.PutUint32(counter, block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
+
+// parseScramAttributes splits a SCRAM message into its attributes, e.g. "r=nonce,s=salt"
+func parseScramAttributes(mechanism string, message string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) < 2 || attribute[1] != '=' {
+			return nil, newError(mechanism, ErrProtocol, "invalid attribute %q", attribute)
+		}
+		attributes[attribute[:1]] = attribute[2:]
+	}
+	return attributes, nil
+}
@@ -0,0 +1,372 @@
+package gosasl
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Test vectors of RFC 6070
+	cases := []struct {
+		password   string
+		salt       string
+		iterations int
+		keyLength  int
+		expected   string
+	}{
+		{"password", "salt", 1, 20, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 25, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, "56fa6aa75548099dcc37d7f03425e0c3"},
+	}
+	for _, c := range cases {
+		key := hex.EncodeToString(pbkdf2(sha1.New, []byte(c.password), []byte(c.salt), c.iterations, c.keyLength))
+		if key != c.expected {
+			t.Fatalf("Expected %s, got %s", c.expected, key)
+		}
+	}
+}
+
+func TestScramMechanism(t *testing.T) {
+	// Examples of RFC 5802 and RFC 7677
+	cases := []struct {
+		mechanism   *ScramMechanism
+		nonce       string
+		clientFirst string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			NewScramSHA1Mechanism("user", "pencil"),
+			"fyko+d2lbbFgONRv9qkxdawL",
+			"n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			NewScramSHA256Mechanism("user", "pencil"),
+			"rOprNGfwEbeRWgbNEkqO",
+			"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+	for _, c := range cases {
+		c.mechanism.clientNonce = c.nonce
+		client := NewSaslClient("localhost", c.mechanism)
+		response, err := client.Start()
+		if err != nil || string(response) != c.clientFirst {
+			t.Fatalf("Expected %q, got %q: %v", c.clientFirst, response, err)
+		}
+		response, err = client.Step([]byte(c.serverFirst))
+		if err != nil || string(response) != c.clientFinal {
+			t.Fatalf("Expected %q, got %q: %v", c.clientFinal, response, err)
+		}
+		if _, err := client.Step([]byte(c.serverFinal)); err != nil {
+			t.Fatal(err)
+		}
+		if !client.Complete() {
+			t.Fatal("The client should be complete")
+		}
+	}
+}
+
+func TestScramMechanismAuthorizationID(t *testing.T) {
+	mechanism := NewScramSHA512Mechanism("us,er", "pencil")
+	mechanism.Config().AuthorizationID = "ad=min"
+	response, err := NewSaslClient("localhost", mechanism).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "n,a=ad=3Dmin,n=us=2Cer,r=" + mechanism.clientNonce
+	if string(response) != expected || len(mechanism.clientNonce) != 24 {
+		t.Fatalf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestScramMechanismErrors(t *testing.T) {
+	serverFirst := "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"
+	start := func() *Client {
+		mechanism := NewScramSHA1Mechanism("user", "pencil")
+		mechanism.clientNonce = "fyko+d2lbbFgONRv9qkxdawL"
+		client := NewSaslClient("localhost", mechanism)
+		client.Start()
+		return client
+	}
+
+	for _, challenge := range []string{
+		"r=other3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"r=fyko+d2lbbFgONRv9qkxdawL,s=QSXCR+Q6sek8bf92,i=4096",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=,i=4096",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=0",
+		"m=ext,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"garbage",
+	} {
+		if _, err := start().Step([]byte(challenge)); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("%q: expected ErrProtocol, got %v", challenge, err)
+		}
+	}
+
+	client := start()
+	client.Step([]byte(serverFirst))
+	_, err := client.Step([]byte("e=invalid-proof"))
+	var scramErr *ScramError
+	if !errors.Is(err, ErrBadCredentials) || !errors.As(err, &scramErr) || scramErr.Value != "invalid-proof" {
+		t.Fatalf("Expected a ScramError, got %v", err)
+	}
+	if _, err := start().Step([]byte("e=other-error")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+
+	client = start()
+	client.Step([]byte(serverFirst))
+	if _, err := client.Step([]byte("v=AAAAAAAAAAAAAAAAAAAAAAAAAAA=")); !errors.Is(err, ErrServerAuthentication) {
+		t.Fatalf("Expected ErrServerAuthentication, got %v", err)
+	}
+	if client.Complete() {
+		t.Fatal("The client shouldn't be complete")
+	}
+}
+
+func TestScramMechanismIterations(t *testing.T) {
+	step := func(mechanism *ScramMechanism, iterations string) error {
+		mechanism.clientNonce = "fyko+d2lbbFgONRv9qkxdawL"
+		client := NewSaslClient("localhost", mechanism)
+		client.Start()
+		_, err := client.Step([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=" + iterations))
+		return err
+	}
+	for _, iterations := range []string{"4095", "1000001", "2147483647"} {
+		if err := step(NewScramSHA1Mechanism("user", "pencil"), iterations); !errors.Is(err, ErrSecurityPolicy) {
+			t.Fatalf("i=%s: expected ErrSecurityPolicy, got %v", iterations, err)
+		}
+	}
+	mechanism := NewScramSHA1Mechanism("user", "pencil")
+	mechanism.MinIterations = 1
+	if err := step(mechanism, "1024"); err != nil {
+		t.Fatalf("The lower bound should be configurable: %v", err)
+	}
+	mechanism = NewScramSHA1Mechanism("user", "pencil")
+	mechanism.MaxIterations = 4096
+	if err := step(mechanism, "4097"); !errors.Is(err, ErrSecurityPolicy) {
+		t.Fatalf("Expected ErrSecurityPolicy, got %v", err)
+	}
+}
+
+func TestScramMechanismRegistered(t *testing.T) {
+	for _, name := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		mechanism, err := NewMechanism(name, Credentials{Username: "user", Password: "pencil"})
+		if err != nil || mechanism.Config().Name() != name {
+			t.Fatalf("%s: unexpected mechanism: %v", name, err)
+		}
+	}
+	client, err := NewSaslClientFromOffer("localhost", []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-256"}, Credentials{Username: "user", Password: "pencil"})
+	if err != nil || client.GetConfig().Name() != "SCRAM-SHA-256" {
+		t.Fatalf("Expected SCRAM-SHA-256 to be picked: %v", err)
+	}
+}
+
+func TestScramPlusMechanism(t *testing.T) {
+	state := tls.ConnectionState{
+		HandshakeComplete: true,
+		Version:           tls.VersionTLS12,
+		TLSUnique:         []byte("0123456789ab"),
+	}
+	mechanism := NewScramSHA256PlusMechanism("user", "pencil", state)
+	mechanism.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+	client := NewSaslClient("localhost", mechanism)
+	if mechanism.Config().Name() != "SCRAM-SHA-256-PLUS" {
+		t.Fatalf("Unexpected name %s", mechanism.Config().Name())
+	}
+	response, err := client.Start()
+	if err != nil || string(response) != "p=tls-unique,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("Unexpected client first message %q: %v", response, err)
+	}
+	response, err = client.Step([]byte("r=rOprNGfwEbeRWgbNEkqOserver,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	binding := base64.StdEncoding.EncodeToString([]byte("p=tls-unique,,0123456789ab"))
+	if err != nil || !strings.HasPrefix(string(response), "c="+binding+",") {
+		t.Fatalf("Unexpected client final message %q: %v", response, err)
+	}
+
+	// A client able to bind but not offered -PLUS tells the server with the y flag
+	mechanism = NewScramSHA256Mechanism("user", "pencil")
+	mechanism.TLS = &state
+	response, err = NewSaslClient("localhost", mechanism).Start()
+	if err != nil || !strings.HasPrefix(string(response), "y,,n=user,") {
+		t.Fatalf("Unexpected client first message %q: %v", response, err)
+	}
+
+	state.TLSUnique = nil
+	_, err = NewSaslClient("localhost", NewScramSHA1PlusMechanism("user", "pencil", state)).Start()
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("Expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestScramPlusMechanismRegistered(t *testing.T) {
+	offer := []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}
+	if _, err := NewMechanism("SCRAM-SHA-256-PLUS", Credentials{Username: "user"}); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("Expected ErrMissingCredentials, got %v", err)
+	}
+	client, err := NewSaslClientFromOffer("localhost", offer, Credentials{Username: "user", Password: "pencil"})
+	if err != nil || client.GetConfig().Name() != "SCRAM-SHA-256" {
+		t.Fatalf("Expected SCRAM-SHA-256 to be picked without TLS: %v", err)
+	}
+	credentials := Credentials{Username: "user", Password: "pencil", TLS: &tls.ConnectionState{HandshakeComplete: true}}
+	client, err = NewSaslClientFromOffer("localhost", offer, credentials)
+	if err != nil || client.GetConfig().Name() != "SCRAM-SHA-256-PLUS" {
+		t.Fatalf("Expected SCRAM-SHA-256-PLUS to be picked over TLS: %v", err)
+	}
+}
+
+// testScramStore knows "user" with the password "pencil" and the salt of RFC 7677
+var testScramStore = ScramCredentialStoreFunc(func(mechanism string, username string) (ScramCredentials, bool, error) {
+	if username != "user" {
+		return ScramCredentials{}, false, nil
+	}
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	credentials, err := NewScramCredentials(mechanism, "pencil", salt, 4096)
+	return credentials, err == nil, err
+})
+
+func TestScramServerMechanism(t *testing.T) {
+	// Example of RFC 7677
+	mechanism := NewScramSHA256ServerMechanism(testScramStore)
+	mechanism.serverNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	server := NewSaslServer(mechanism)
+	challenge, err := server.Start([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+	expected := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	if err != nil || string(challenge) != expected {
+		t.Fatalf("Expected %q, got %q: %v", expected, challenge, err)
+	}
+	challenge, err = server.Step([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	expected = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	if err != nil || string(challenge) != expected || !server.Complete() || server.AuthenticatedIdentity() != "user" {
+		t.Fatalf("Expected %q, got %q: %v", expected, challenge, err)
+	}
+
+	mechanism = NewScramSHA256ServerMechanism(testScramStore)
+	mechanism.Random = bytes.NewReader(make([]byte, 24))
+	client := NewScramSHA256Mechanism("user", "pencil")
+	client.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+	server = NewSaslServer(mechanism)
+	response, _ := NewSaslClient("localhost", client).Start()
+	challenge, err = server.Start(response)
+	expected = "r=rOprNGfwEbeRWgbNEkqO" + strings.Repeat("a", 24) + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	if err != nil || string(challenge) != expected {
+		t.Fatalf("Expected %q, got %q: %v", expected, challenge, err)
+	}
+}
+
+// scramRejection runs the exchange until the server error and returns the errors of both
+// sides
+func scramRejection(client *Client, server *Server) (error, error) {
+	clientErr := negotiate(client, server)
+	_, serverErr := server.Step([]byte{})
+	return clientErr, serverErr
+}
+
+func TestScramServerMechanismRejections(t *testing.T) {
+	clientErr, serverErr := scramRejection(NewSaslClient("localhost", NewScramSHA1Mechanism("user", "wrong")), NewSaslServer(NewScramSHA1ServerMechanism(testScramStore)))
+	var scramErr *ScramError
+	if !errors.As(clientErr, &scramErr) || scramErr.Value != "invalid-proof" || !errors.Is(serverErr, ErrBadCredentials) {
+		t.Fatalf("Expected invalid-proof, got %v and %v", clientErr, serverErr)
+	}
+
+	// Unknown users get the same salt each time and are rejected like a wrong password
+	var salts []string
+	for i := 0; i < 2; i++ {
+		server := NewSaslServer(NewScramSHA1ServerMechanism(testScramStore))
+		challenge, _ := server.Start([]byte("n,,n=nobody,r=nonce"))
+		attributes, _ := parseScramAttributes("SCRAM-SHA-1", string(challenge))
+		salts = append(salts, attributes["s"])
+		clientErr, serverErr = scramRejection(NewSaslClient("localhost", NewScramSHA1Mechanism("nobody", "pencil")), NewSaslServer(NewScramSHA1ServerMechanism(testScramStore)))
+		if !errors.As(clientErr, &scramErr) || scramErr.Value != "invalid-proof" || !errors.Is(serverErr, ErrBadCredentials) {
+			t.Fatalf("Expected invalid-proof, got %v and %v", clientErr, serverErr)
+		}
+	}
+	if salts[0] == "" || salts[0] != salts[1] {
+		t.Fatalf("Expected the same salt, got %v", salts)
+	}
+	mechanism := NewScramSHA1ServerMechanism(testScramStore)
+	mechanism.Iterations = 10000
+	challenge, _ := NewSaslServer(mechanism).Start([]byte("n,,n=nobody,r=nonce"))
+	if attributes, _ := parseScramAttributes("SCRAM-SHA-1", string(challenge)); attributes["i"] != "10000" {
+		t.Fatalf("Expected the configured iteration count, got %q", challenge)
+	}
+
+	client := NewScramSHA256Mechanism("user", "pencil")
+	client.Config().AuthorizationID = "admin"
+	clientErr, serverErr = scramRejection(NewSaslClient("localhost", client), NewSaslServer(NewScramSHA256ServerMechanism(testScramStore)))
+	if !errors.As(clientErr, &scramErr) || scramErr.Value != "other-error" || !errors.Is(serverErr, ErrNotAuthorized) {
+		t.Fatalf("Expected other-error, got %v and %v", clientErr, serverErr)
+	}
+
+	server := NewSaslServer(NewScramSHA256ServerMechanism(testScramStore))
+	if _, err := server.Start([]byte("p=tls-unique,,n=user,r=nonce")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+	server = NewSaslServer(NewScramSHA256PlusServerMechanism(testScramStore, tls.ConnectionState{}))
+	if _, err := server.Start([]byte("y,,n=user,r=nonce")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("The y flag sent to a -PLUS variant should fail, got %v", err)
+	}
+}
+
+func TestScramServerMechanismChannelBinding(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		clientState, serverState := tlsPair(t, version)
+		server := NewSaslServer(NewScramSHA256PlusServerMechanism(testScramStore, serverState))
+		client := NewSaslClient("localhost", NewScramSHA256PlusMechanism("user", "pencil", clientState))
+		if err := negotiate(client, server); err != nil || !client.Complete() || !server.Complete() {
+			t.Fatalf("Unexpected failure: %v", err)
+		}
+	}
+
+	clientState, serverState := tlsPair(t, tls.VersionTLS12)
+	mechanism := NewScramSHA256PlusServerMechanism(testScramStore, serverState)
+	scram := NewScramSHA256PlusMechanism("user", "pencil", clientState)
+	scram.ChannelBindingType = ChannelBindingTLSServerEndPoint
+	clientErr, serverErr := scramRejection(NewSaslClient("localhost", scram), NewSaslServer(mechanism))
+	var scramErr *ScramError
+	if !errors.As(clientErr, &scramErr) || scramErr.Value != "unsupported-channel-binding-type" || !errors.Is(serverErr, ErrProtocol) {
+		t.Fatalf("Expected unsupported-channel-binding-type, got %v and %v", clientErr, serverErr)
+	}
+	mechanism = NewScramSHA256PlusServerMechanism(testScramStore, serverState)
+	mechanism.Certificate = clientState.PeerCertificates[0]
+	scram = NewScramSHA256PlusMechanism("user", "pencil", clientState)
+	scram.ChannelBindingType = ChannelBindingTLSServerEndPoint
+	if err := negotiate(NewSaslClient("localhost", scram), NewSaslServer(mechanism)); err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+
+	// A client on another connection, e.g. behind a man in the middle
+	otherState, _ := tlsPair(t, tls.VersionTLS12)
+	clientErr, _ = scramRejection(NewSaslClient("localhost", NewScramSHA256PlusMechanism("user", "pencil", otherState)), NewSaslServer(NewScramSHA256PlusServerMechanism(testScramStore, serverState)))
+	if !errors.As(clientErr, &scramErr) || scramErr.Value != "channel-bindings-dont-match" {
+		t.Fatalf("Expected channel-bindings-dont-match, got %v", clientErr)
+	}
+
+	// The client supports channel binding but the -PLUS variants weren't offered
+	scram = NewScramSHA256Mechanism("user", "pencil")
+	scram.TLS = &clientState
+	mechanism = NewScramSHA256ServerMechanism(testScramStore)
+	mechanism.TLS = &serverState
+	clientErr, _ = scramRejection(NewSaslClient("localhost", scram), NewSaslServer(mechanism))
+	if !errors.As(clientErr, &scramErr) || scramErr.Value != "server-does-support-channel-binding" {
+		t.Fatalf("Expected server-does-support-channel-binding, got %v", clientErr)
+	}
+	scram = NewScramSHA256Mechanism("user", "pencil")
+	scram.TLS = &clientState
+	if err := negotiate(NewSaslClient("localhost", scram), NewSaslServer(NewScramSHA256ServerMechanism(testScramStore))); err != nil {
+		t.Fatalf("Servers without channel binding should accept the y flag: %v", err)
+	}
+}
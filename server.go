@@ -0,0 +1,338 @@
+package gosasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServerMechanism is the common interface for the server side of mechanisms. It can be
+// implemented outside this package to plug custom mechanisms into a Server.
+type ServerMechanism interface {
+	// Start processes the initial response of the client, nil if it didn't send one, and
+	// returns the first challenge
+	Start(initialResponse []byte) ([]byte, error)
+	// Step processes a response from the client and returns the next challenge. Once the
+	// mechanism completes the returned bytes, if any, are the additional data to send
+	// along with the success outcome.
+	Step(response []byte) ([]byte, error)
+	// Encode is applied on the outgoing bytes once the security layer is established
+	Encode(outgoing []byte) ([]byte, error)
+	// Decode is applied on the incoming bytes once the security layer is established
+	Decode(incoming []byte) ([]byte, error)
+	// Dispose eliminates sensitive information
+	Dispose()
+	// Config returns the configuration of the mechanism. Once complete its authenticated
+	// identity and AuthorizationID describe the client.
+	Config() *MechanismConfig
+}
+
+// Verifier checks the password of a user for the server side of password mechanisms
+type Verifier interface {
+	// Verify returns false if the password doesn't match. Errors are reserved for failures
+	// to check it, e.g. the user database being unavailable.
+	Verify(username string, password string) (bool, error)
+}
+
+// VerifierFunc adapts a function to the Verifier interface
+type VerifierFunc func(username string, password string) (bool, error)
+
+// Verify calls f(username, password)
+func (f VerifierFunc) Verify(username string, password string) (bool, error) {
+	return f(username, password)
+}
+
+// SecretLookup returns the shared secret of a user for the server side of challenge-response
+// mechanisms such as CRAM-MD5 and DIGEST-MD5
+type SecretLookup interface {
+	// LookupSecret returns found as false if the user doesn't exist. Errors are reserved
+	// for failures to look it up.
+	LookupSecret(username string) (secret string, found bool, err error)
+}
+
+// SecretLookupFunc adapts a function to the SecretLookup interface
+type SecretLookupFunc func(username string) (secret string, found bool, err error)
+
+// LookupSecret calls f(username)
+func (f SecretLookupFunc) LookupSecret(username string) (string, bool, error) {
+	return f(username)
+}
+
+// Authorizer decides whether the authenticated identity may act as the requested
+// authorization identity, e.g. a proxy user impersonating the end user. It is shared by
+// all the server mechanisms, those with a nil Authorizer only let clients act as
+// themselves.
+type Authorizer interface {
+	// Authorize returns an error to deny authenticationID acting as authorizationID
+	Authorize(authenticationID string, authorizationID string) error
+}
+
+// AuthorizeFunc adapts a function to the Authorizer interface
+type AuthorizeFunc func(authenticationID string, authorizationID string) error
+
+// Authorize calls f(authenticationID, authorizationID)
+func (f AuthorizeFunc) Authorize(authenticationID string, authorizationID string) error {
+	return f(authenticationID, authorizationID)
+}
+
+// authorize checks that authenticationID can act as authorizationID and records both on
+// the configuration. Acting as oneself is always allowed, anything else requires the
+// authorizer to allow it.
+func authorize(config *MechanismConfig, authorizer Authorizer, authenticationID string, authorizationID string) error {
+	if authorizationID != "" && authorizationID != authenticationID {
+		if authorizer == nil {
+			return newError(config.name, ErrNotAuthorized, "%s can't act as %s", authenticationID, authorizationID)
+		}
+		if err := authorizer.Authorize(authenticationID, authorizationID); err != nil {
+			return &Error{Mechanism: config.name, Kind: ErrNotAuthorized, Message: authenticationID + " can't act as " + authorizationID, Err: err}
+		}
+	}
+	config.identity = authenticationID
+	config.AuthorizationID = authorizationID
+	return nil
+}
+
+// verify checks the password with the verifier, a mismatch is reported as ErrBadCredentials
+func verify(config *MechanismConfig, verifier Verifier, username string, password string) error {
+	ok, err := verifier.Verify(username, password)
+	if err != nil {
+		return &Error{Mechanism: config.name, Kind: ErrVerifier, Message: "the password can't be verified", Err: err}
+	}
+	if !ok {
+		return newError(config.name, ErrBadCredentials, "invalid password for %s", username)
+	}
+	return nil
+}
+
+// lookupSecret returns the secret of username, or a fakeSecret if the user doesn't exist
+func lookupSecret(config *MechanismConfig, secrets SecretLookup, username string) (string, bool, error) {
+	secret, found, err := secrets.LookupSecret(username)
+	if err != nil {
+		return "", false, &Error{Mechanism: config.name, Kind: ErrVerifier, Message: "the secret can't be looked up", Err: err}
+	}
+	if !found {
+		secret = hex.EncodeToString(fakeSecret(username))
+	}
+	return secret, found, nil
+}
+
+var (
+	fakeSecretKeyOnce sync.Once
+	fakeSecretKey     []byte
+)
+
+// fakeSecret returns the secret of a user that doesn't exist, derived from a key drawn once
+// so that it is the same on every attempt. The server mechanisms check the credentials of
+// unknown users against it, with the same computations as for existing users and
+// matchProof, so that neither the time taken nor the messages sent tell whether a user
+// exists.
+func fakeSecret(username string) []byte {
+	fakeSecretKeyOnce.Do(func() {
+		fakeSecretKey = make([]byte, 32)
+		rand.Read(fakeSecretKey)
+	})
+	mac := hmac.New(sha256.New, fakeSecretKey)
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
+// matchProof compares the proof sent by the client with the expected one in constant time.
+// It always fails for unknown users, whose expected proof comes from a fakeSecret.
+func matchProof(expected []byte, proof []byte, found bool) bool {
+	return hmac.Equal(expected, proof) && found
+}
+
+// offerable checks that a mechanism can be offered to a client on the connection. Without
+// TLS, mechanisms sending the password in the clear or bound to TLS are excluded.
+func offerable(config *MechanismConfig, conn ConnectionInfo) error {
+	if !conn.encrypted() {
+		if config.usesPlaintext {
+			return newError(config.name, ErrSecurityPolicy, "the password would be sent in the clear")
+		}
+		if config.channelBinding {
+			return newError(config.name, ErrSecurityPolicy, "the mechanism needs TLS")
+		}
+	}
+	return conn.Policy.check(config)
+}
+
+// Server is the entry point for the server side of this library, it mirrors Client
+type Server struct {
+	mechanism ServerMechanism
+	state     State
+	// candidates are the mechanisms advertised to the client, until it selects one
+	candidates map[string]ServerMechanism
+}
+
+// NewSaslServer creates a new server given a mechanism. The mechanism can be nil to let the
+// client choose among the registered server mechanisms, see AdvertisedMechanisms.
+func NewSaslServer(mechanism ServerMechanism) *Server {
+	return &Server{
+		mechanism: mechanism,
+	}
+}
+
+// AdvertisedMechanisms returns the names of the registered server mechanisms that can be
+// offered on the connection, strongest first, e.g. for an IMAP CAPABILITY response. PLAIN
+// and other mechanisms sending the password in the clear are only offered over TLS, and so
+// are EXTERNAL and the mechanisms using channel binding. The client then picks one of them
+// with SelectMechanism. It returns nil if the server was created with a mechanism.
+func (server *Server) AdvertisedMechanisms(conn ConnectionInfo) []string {
+	if server.mechanism != nil || server.state != StateNew {
+		return nil
+	}
+	server.disposeCandidates()
+	server.candidates = make(map[string]ServerMechanism)
+	var names []string
+	for _, name := range ServerMechanisms() {
+		mechanism, err := newServerMechanism(name, conn)
+		if err != nil {
+			continue
+		}
+		if offerable(mechanism.Config(), conn) != nil {
+			mechanism.Dispose()
+			continue
+		}
+		server.candidates[name] = mechanism
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return server.candidates[names[i]].Config().score > server.candidates[names[j]].Config().score
+	})
+	return names
+}
+
+// SelectMechanism sets the mechanism chosen by the client. It fails with
+// ErrUnsupportedMechanism unless the mechanism was returned by AdvertisedMechanisms.
+func (server *Server) SelectMechanism(name string) error {
+	if server.mechanism != nil || server.state != StateNew {
+		return &StateError{Op: "SelectMechanism", State: server.state}
+	}
+	mechanism, ok := server.candidates[strings.ToUpper(name)]
+	if !ok {
+		return newError(name, ErrUnsupportedMechanism, "the mechanism wasn't advertised")
+	}
+	delete(server.candidates, strings.ToUpper(name))
+	server.disposeCandidates()
+	server.mechanism = mechanism
+	return nil
+}
+
+// disposeCandidates disposes the advertised mechanisms that weren't selected
+func (server *Server) disposeCandidates() {
+	for _, mechanism := range server.candidates {
+		mechanism.Dispose()
+	}
+	server.candidates = nil
+}
+
+// Start processes the initial response of the client, nil if it didn't send one, and
+// returns the first challenge. It can only be called once.
+func (server *Server) Start(initialResponse []byte) ([]byte, error) {
+	if server.state != StateNew {
+		return nil, &StateError{Op: "Start", State: server.state}
+	}
+	if server.mechanism == nil {
+		return nil, newError("", ErrInvalidState, "no mechanism was selected")
+	}
+	server.state = StateInProgress
+	return server.after(server.mechanism.Start(initialResponse))
+}
+
+// Step processes a response from the client. It fails once the handshake has completed
+// or failed.
+func (server *Server) Step(response []byte) ([]byte, error) {
+	if server.state != StateInProgress {
+		return nil, &StateError{Op: "Step", State: server.state}
+	}
+	return server.after(server.mechanism.Step(response))
+}
+
+// after moves the server to the state matching the outcome of a step
+func (server *Server) after(challenge []byte, err error) ([]byte, error) {
+	if err != nil {
+		server.state = StateFailed
+		return nil, err
+	}
+	if server.mechanism.Config().complete {
+		server.state = StateComplete
+	}
+	return challenge, nil
+}
+
+// State returns the stage of the handshake the server is in
+func (server *Server) State() State {
+	return server.state
+}
+
+// Complete returns true if the client has been authenticated
+func (server *Server) Complete() bool {
+	return server.state == StateComplete
+}
+
+// AuthenticatedIdentity returns the identity whose credentials were verified, it is empty
+// until the handshake completes
+func (server *Server) AuthenticatedIdentity() string {
+	if !server.Complete() {
+		return ""
+	}
+	return server.mechanism.Config().identity
+}
+
+// AuthorizationID returns the identity the client acts as, it is empty until the
+// handshake completes
+func (server *Server) AuthorizationID() string {
+	if !server.Complete() {
+		return ""
+	}
+	return newSession(server.mechanism.Config()).AuthorizationID
+}
+
+// Session returns the parameters negotiated during the handshake. It can only be called
+// once the handshake has completed.
+func (server *Server) Session() (Session, error) {
+	if !server.Complete() {
+		return Session{}, &StateError{Op: "Session", State: server.state}
+	}
+	return newSession(server.mechanism.Config()), nil
+}
+
+// GetConfig returns the configuration of the mechanism, nil until one is selected
+func (server *Server) GetConfig() *MechanismConfig {
+	if server.mechanism == nil {
+		return nil
+	}
+	return server.mechanism.Config()
+}
+
+// Encode is applied on the outgoing bytes to secure them usually
+func (server *Server) Encode(outgoing []byte) ([]byte, error) {
+	if !server.Complete() {
+		return nil, &StateError{Op: "Encode", State: server.state}
+	}
+	return server.mechanism.Encode(outgoing)
+}
+
+// Decode is used on the incoming data to produce the usable bytes
+func (server *Server) Decode(incoming []byte) ([]byte, error) {
+	if !server.Complete() {
+		return nil, &StateError{Op: "Decode", State: server.state}
+	}
+	return server.mechanism.Decode(incoming)
+}
+
+// Dispose eliminates sensitive information
+func (server *Server) Dispose() {
+	if server.state == StateDisposed {
+		return
+	}
+	server.state = StateDisposed
+	server.disposeCandidates()
+	if server.mechanism != nil {
+		server.mechanism.Dispose()
+	}
+}
@@ -0,0 +1,338 @@
+package gosasl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// negotiate runs the handshake between an in-process client and server
+func negotiate(client *Client, server *Server) error {
+	response, err := client.Start()
+	if err != nil {
+		return err
+	}
+	challenge, err := server.Start(response)
+	for i := 0; err == nil && !server.Complete(); i++ {
+		if i > 10 {
+			return errors.New("the handshake doesn't finish")
+		}
+		if response, err = client.Step(challenge); err != nil {
+			return err
+		}
+		challenge, err = server.Step(response)
+	}
+	if err != nil {
+		return err
+	}
+	if !client.Complete() {
+		// The server sent additional data along with the success outcome
+		if _, err := client.Step(challenge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAnonymousServerMechanism(t *testing.T) {
+	mechanism := NewAnonymousServerMechanism()
+	server := NewSaslServer(mechanism)
+	client := NewSaslClient("localhost", NewAnonymousMechanism())
+	if err := negotiate(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Complete() || server.AuthenticatedIdentity() != "anonymous" || mechanism.Trace != "Anonymous, None" {
+		t.Fatalf("Unexpected outcome: complete %v, identity %q, trace %q", server.Complete(), server.AuthenticatedIdentity(), mechanism.Trace)
+	}
+	session, err := server.Session()
+	if err != nil || session.Mechanism != "ANONYMOUS" {
+		t.Fatalf("Unexpected session %+v: %v", session, err)
+	}
+	server.Dispose()
+}
+
+func TestServerState(t *testing.T) {
+	server := NewSaslServer(NewAnonymousServerMechanism())
+	if _, err := server.Step([]byte("trace")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Step before Start should fail, got %v", err)
+	}
+	challenge, err := server.Start(nil)
+	if err != nil || challenge == nil || len(challenge) != 0 {
+		t.Fatalf("Expected an empty challenge, got %q: %v", challenge, err)
+	}
+	if server.AuthenticatedIdentity() != "" {
+		t.Fatal("There is no identity before the handshake completes")
+	}
+	if _, err := server.Encode([]byte("data")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Encode before completion should fail, got %v", err)
+	}
+	if _, err := server.Step([]byte("\xff")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Invalid UTF-8 should fail, got %v", err)
+	}
+	if server.State() != StateFailed {
+		t.Fatalf("Expected %s, got %s", StateFailed, server.State())
+	}
+	if _, err := server.Step([]byte("trace")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Step after a failure should fail, got %v", err)
+	}
+}
+
+var testVerifier = VerifierFunc(func(username string, password string) (bool, error) {
+	if username == "broken" {
+		return false, errors.New("database unavailable")
+	}
+	return username == "user" && password == "password", nil
+})
+
+func TestPlainServerMechanism(t *testing.T) {
+	server := NewSaslServer(NewPlainServerMechanism(testVerifier))
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "password"))
+	if err := negotiate(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "user" || server.AuthorizationID() != "user" {
+		t.Fatalf("Unexpected identities %q, %q", server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+}
+
+func TestPlainServerMechanismAuthorization(t *testing.T) {
+	mechanism := NewPlainServerMechanism(testVerifier)
+	server := NewSaslServer(mechanism)
+	if _, err := server.Start([]byte("admin\x00user\x00password")); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Acting as someone else should be denied by default, got %v", err)
+	}
+
+	mechanism = NewPlainServerMechanism(testVerifier)
+	mechanism.Authorizer = AuthorizeFunc(func(authenticationID string, authorizationID string) error {
+		if authorizationID != "guest" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	server = NewSaslServer(mechanism)
+	if _, err := server.Start([]byte("guest\x00user\x00password")); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "user" || server.AuthorizationID() != "guest" {
+		t.Fatalf("Unexpected identities %q, %q", server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+}
+
+func TestPlainServerMechanismErrors(t *testing.T) {
+	long := strings.Repeat("p", PLAIN_MAX_FIELD_LENGTH+1)
+	cases := map[string]error{
+		"user\x00password":         ErrProtocol,
+		"\x00user\x00pass\x00word": ErrProtocol,
+		"\x00us\xffer\x00password": ErrProtocol,
+		"\x00user\x00":             ErrProtocol,
+		"\x00\x00password":         ErrProtocol,
+		"\x00user\x00" + long:      ErrProtocol,
+		"\x00user\x00wrong":        ErrBadCredentials,
+		"\x00broken\x00password":   ErrVerifier,
+	}
+	for message, expected := range cases {
+		server := NewSaslServer(NewPlainServerMechanism(testVerifier))
+		if _, err := server.Start([]byte(message)); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", message, expected, err)
+		}
+	}
+}
+
+var testSecrets = SecretLookupFunc(func(username string) (string, bool, error) {
+	switch username {
+	case "tim":
+		return "tanstaaftanstaaf", true, nil
+	case "user":
+		return "pass", true, nil
+	}
+	return "", false, nil
+})
+
+func TestCramMD5ServerMechanism(t *testing.T) {
+	// Example from RFC 2195
+	mechanism := NewCramMD5ServerMechanism("postoffice.reston.mci.net", testSecrets)
+	mechanism.Random = bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0x07, 0x68})
+	mechanism.Now = func() time.Time { return time.Unix(697170952, 0) }
+	server := NewSaslServer(mechanism)
+	challenge, err := server.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(challenge) != "<1896.697170952@postoffice.reston.mci.net>" {
+		t.Fatalf("Unexpected challenge %s", challenge)
+	}
+	if _, err := server.Step([]byte("tim b913a602c7eda7a495b4e6e7334d3890")); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Complete() || server.AuthenticatedIdentity() != "tim" {
+		t.Fatalf("Unexpected identity %q", server.AuthenticatedIdentity())
+	}
+}
+
+func TestCramMD5ServerMechanismWithClient(t *testing.T) {
+	server := NewSaslServer(NewCramMD5ServerMechanism("localhost", testSecrets))
+	client := NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	if err := negotiate(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "user" {
+		t.Fatalf("Unexpected identity %q", server.AuthenticatedIdentity())
+	}
+}
+
+func TestCramMD5ServerMechanismErrors(t *testing.T) {
+	cases := map[string]error{
+		"tim b913a602c7eda7a495b4e6e7334d3891":    ErrBadCredentials,
+		"nobody b913a602c7eda7a495b4e6e7334d3890": ErrBadCredentials,
+		"tim":                                      ErrProtocol,
+		"b913a602c7eda7a495b4e6e7334d3890":         ErrProtocol,
+		"tim zz13a602c7eda7a495b4e6e7334d3890":     ErrProtocol,
+		"\xfftim b913a602c7eda7a495b4e6e7334d3890": ErrProtocol,
+	}
+	for response, expected := range cases {
+		mechanism := NewCramMD5ServerMechanism("postoffice.reston.mci.net", testSecrets)
+		mechanism.Random = bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0x07, 0x68})
+		mechanism.Now = func() time.Time { return time.Unix(697170952, 0) }
+		server := NewSaslServer(mechanism)
+		server.Start(nil)
+		if _, err := server.Step([]byte(response)); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", response, expected, err)
+		}
+	}
+	if _, err := NewSaslServer(NewCramMD5ServerMechanism("localhost", testSecrets)).Start([]byte("tim")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("An initial response should fail, got %v", err)
+	}
+}
+
+func digestMD5Pair(username string, password string) (*Client, *Server, *DigestMD5ServerMechanism) {
+	mechanism := NewDigestMD5ServerMechanism("imap", "elwood.innosoft.com", "elwood.innosoft.com", testSecrets)
+	client := NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", username, password))
+	return client, NewSaslServer(mechanism), mechanism
+}
+
+func TestDigestMD5ServerMechanism(t *testing.T) {
+	client, server, mechanism := digestMD5Pair("user", "pass")
+	client.GetConfig().AuthorizationID = "guest"
+	mechanism.Authorizer = AuthorizeFunc(func(authenticationID string, authorizationID string) error {
+		return nil
+	})
+	if err := negotiate(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if !client.Complete() || server.AuthenticatedIdentity() != "user" || server.AuthorizationID() != "guest" {
+		t.Fatalf("Unexpected outcome: client complete %v, identities %q, %q", client.Complete(), server.AuthenticatedIdentity(), server.AuthorizationID())
+	}
+}
+
+func TestDigestMD5ServerMechanismErrors(t *testing.T) {
+	client, server, _ := digestMD5Pair("user", "wrong")
+	if err := negotiate(client, server); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Expected ErrBadCredentials, got %v", err)
+	}
+
+	client, server, _ = digestMD5Pair("user", "pass")
+	client.GetConfig().AuthorizationID = "guest"
+	if err := negotiate(client, server); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Expected ErrNotAuthorized, got %v", err)
+	}
+
+	client, server, _ = digestMD5Pair("user", "pass")
+	client.host = "elsewhere.innosoft.com"
+	client.mechanism.(*DigestMD5Mechanism).host = "elsewhere.innosoft.com"
+	if err := negotiate(client, server); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol for another host, got %v", err)
+	}
+}
+
+func TestDigestMD5ServerMechanismRejectsReplays(t *testing.T) {
+	client, _, mechanism := digestMD5Pair("user", "pass")
+	challenge, _ := mechanism.Start(nil)
+	client.Start()
+	response, err := client.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mechanism.Step(response); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mechanism.Step(response); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("A replayed response should fail, got %v", err)
+	}
+
+	_, _, other := digestMD5Pair("user", "pass")
+	other.Start(nil)
+	if _, err := other.Step(response); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("A response to another nonce should fail, got %v", err)
+	}
+}
+
+func TestServerAdvertisedMechanisms(t *testing.T) {
+	RegisterServerMechanism("ANONYMOUS", func(conn ConnectionInfo) (ServerMechanism, error) {
+		return NewAnonymousServerMechanism(), nil
+	})
+	RegisterServerMechanism("PLAIN", func(conn ConnectionInfo) (ServerMechanism, error) {
+		return NewPlainServerMechanism(testVerifier), nil
+	})
+	RegisterServerMechanism("CRAM-MD5", func(conn ConnectionInfo) (ServerMechanism, error) {
+		return NewCramMD5ServerMechanism("localhost", testSecrets), nil
+	})
+	RegisterServerMechanism("EXTERNAL", func(conn ConnectionInfo) (ServerMechanism, error) {
+		if conn.TLS == nil {
+			return NewExternalServerMechanism(tls.ConnectionState{}), nil
+		}
+		return NewExternalServerMechanism(*conn.TLS), nil
+	})
+	RegisterServerMechanism("X-BROKEN", func(conn ConnectionInfo) (ServerMechanism, error) {
+		return nil, errors.New("misconfigured")
+	})
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for _, name := range []string{"ANONYMOUS", "PLAIN", "CRAM-MD5", "EXTERNAL", "X-BROKEN"} {
+			delete(serverRegistry, name)
+		}
+	})
+
+	tlsConn := ConnectionInfo{TLS: &tls.ConnectionState{HandshakeComplete: true}}
+	cases := []struct {
+		conn     ConnectionInfo
+		expected []string
+	}{
+		{ConnectionInfo{}, []string{"CRAM-MD5", "ANONYMOUS"}},
+		{tlsConn, []string{"CRAM-MD5", "PLAIN", "ANONYMOUS", "EXTERNAL"}},
+		{ConnectionInfo{TLS: tlsConn.TLS, Policy: SecurityPolicy{NoAnonymous: true}}, []string{"CRAM-MD5", "PLAIN", "EXTERNAL"}},
+	}
+	for _, c := range cases {
+		advertised := NewSaslServer(nil).AdvertisedMechanisms(c.conn)
+		if strings.Join(advertised, " ") != strings.Join(c.expected, " ") {
+			t.Fatalf("Expected %v, got %v", c.expected, advertised)
+		}
+	}
+
+	server := NewSaslServer(nil)
+	if _, err := server.Start(nil); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Start without a mechanism should fail, got %v", err)
+	}
+	server.AdvertisedMechanisms(ConnectionInfo{})
+	if err := server.SelectMechanism("PLAIN"); !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Fatalf("PLAIN wasn't advertised without TLS, got %v", err)
+	}
+	if err := server.SelectMechanism("cram-md5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SelectMechanism("ANONYMOUS"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Selecting twice should fail, got %v", err)
+	}
+	if err := negotiate(NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass")), server); err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthenticatedIdentity() != "user" {
+		t.Fatalf("Unexpected identity %q", server.AuthenticatedIdentity())
+	}
+	if NewSaslServer(NewAnonymousServerMechanism()).AdvertisedMechanisms(ConnectionInfo{}) != nil {
+		t.Fatal("A server created with a mechanism doesn't advertise")
+	}
+}
@@ -0,0 +1,45 @@
+package gosasl
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "password"))
+	client.GetConfig().AuthorizationID = "authId"
+	if _, err := client.Session(); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Session before the handshake should fail, got %v", err)
+	}
+	client.Start()
+	client.Step(nil)
+
+	session, err := client.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Session{
+		Mechanism:             "PLAIN",
+		AuthenticatedIdentity: "user",
+		AuthorizationID:       "authId",
+		QOP:                   AUTH,
+		SSF:                   0,
+	}
+	if !reflect.DeepEqual(session, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, session)
+	}
+}
+
+func TestSessionDefaultsAuthorizationID(t *testing.T) {
+	client := NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	client.Start()
+	client.Step([]byte("msg"))
+	session, err := client.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Mechanism != "CRAM-MD5" || session.AuthenticatedIdentity != "user" || session.AuthorizationID != "user" {
+		t.Fatalf("Unexpected session %+v", session)
+	}
+}
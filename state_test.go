@@ -0,0 +1,88 @@
+package gosasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClientStateTransitions(t *testing.T) {
+	client := NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	if client.State() != StateNew {
+		t.Fatalf("Expected %s, got %s", StateNew, client.State())
+	}
+	if _, err := client.Step([]byte("msg")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Step before Start should fail, got %v", err)
+	}
+	if _, err := client.Encode([]byte("data")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Encode before the negotiation should fail, got %v", err)
+	}
+
+	client.Start()
+	if client.State() != StateInProgress {
+		t.Fatalf("Expected %s, got %s", StateInProgress, client.State())
+	}
+	if _, err := client.Start(); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Start twice should fail, got %v", err)
+	}
+
+	client.Step([]byte("msg"))
+	if client.State() != StateComplete {
+		t.Fatalf("Expected %s, got %s", StateComplete, client.State())
+	}
+	if _, err := client.Step([]byte("msg")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Step after completion should fail, got %v", err)
+	}
+	if _, err := client.Encode([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Dispose()
+	var stateErr *StateError
+	if _, err := client.Decode([]byte("data")); !errors.As(err, &stateErr) || stateErr.State != StateDisposed {
+		t.Fatalf("Decode after Dispose should fail, got %v", err)
+	}
+	client.Dispose()
+}
+
+func TestClientStateAfterFailure(t *testing.T) {
+	client := NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "chris", "secret"))
+	client.Start()
+	if _, err := client.Step([]byte("realm")); err == nil {
+		t.Fatal("A malformed challenge should fail")
+	}
+	if client.State() != StateFailed {
+		t.Fatalf("Expected %s, got %s", StateFailed, client.State())
+	}
+	if _, err := client.Step([]byte(`nonce="OA6MG9tEQGm2hh"`)); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Step after a failure should fail, got %v", err)
+	}
+}
+
+func TestClientStateWithInitialResponse(t *testing.T) {
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "pass"))
+	transport := &scriptedTransport{messages: []serverMessage{{StatusComplete, nil}}}
+	if err := client.Authenticate(context.Background(), transport); err != nil {
+		t.Fatal(err)
+	}
+	if client.State() != StateComplete {
+		t.Fatalf("Expected %s, got %s", StateComplete, client.State())
+	}
+	if err := client.Authenticate(context.Background(), transport); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("Authenticating twice should fail, got %v", err)
+	}
+}
+
+func TestClientStateAfterBadServerAuthentication(t *testing.T) {
+	client := NewSaslClient("elwood.innosoft.com", NewDigestMD5Mechanism("imap", "chris", "secret"))
+	client.Start()
+	if _, err := client.Step([]byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth"`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Step([]byte("rspauth=00000000000000000000000000000000")); !errors.Is(err, ErrServerAuthentication) {
+		t.Fatalf("A wrong rspauth should fail, got %v", err)
+	}
+	if client.State() != StateFailed || client.Complete() {
+		t.Fatalf("Unexpected outcome: state %s, complete %v", client.State(), client.Complete())
+	}
+}
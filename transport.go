@@ -0,0 +1,86 @@
+package gosasl
+
+import (
+	"context"
+)
+
+// Status is the outcome of a step as reported by the server
+type Status int
+
+const (
+	// StatusContinue means the server sent a challenge and expects a response
+	StatusContinue Status = iota
+	// StatusComplete means the server considers the authentication successful
+	StatusComplete
+	// StatusFailed means the server rejected the authentication
+	StatusFailed
+)
+
+// Transport carries the SASL messages of a protocol, e.g. IMAP AUTHENTICATE continuations
+// or Kafka SaslAuthenticate requests.
+type Transport interface {
+	// Send sends a response to the server. The first call carries the initial response,
+	// which is nil if the mechanism doesn't have one.
+	Send(ctx context.Context, response []byte) error
+	// Receive waits for the next message from the server. Protocols that send additional
+	// data along with the outcome, like DIGEST-MD5 rspauth, return it as the challenge.
+	// Along with StatusFailed, err can carry the reason given by the server, e.g. an IMAP
+	// response code, it is then the cause of the ErrAuthenticationFailed error.
+	Receive(ctx context.Context) (status Status, challenge []byte, err error)
+}
+
+// Authenticate runs the whole handshake over the transport. It stops as soon as the
+// context is done, the server rejects the authentication or the server reports success,
+// in which case the mechanism must have completed as well.
+func (client *Client) Authenticate(ctx context.Context, transport Transport) error {
+	err := client.authenticate(ctx, transport)
+	if _, ok := err.(*StateError); err != nil && !ok && client.state == StateInProgress {
+		// The exchange can't be resumed after a transport failure or a cancellation
+		client.state = StateFailed
+	}
+	return err
+}
+
+func (client *Client) authenticate(ctx context.Context, transport Transport) error {
+	response, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := transport.Send(ctx, response); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		status, challenge, err := transport.Receive(ctx)
+		if err != nil && status != StatusFailed {
+			return err
+		}
+		switch status {
+		case StatusContinue:
+			response, err = client.Step(challenge)
+			if err != nil {
+				return err
+			}
+		case StatusComplete:
+			if !client.Complete() && challenge != nil {
+				if _, err := client.Step(challenge); err != nil {
+					return err
+				}
+			}
+			if !client.Complete() {
+				return newError(client.GetConfig().name, ErrProtocol, "the server completed the negotiation before the mechanism")
+			}
+			client.finish()
+			return nil
+		case StatusFailed:
+			return &Error{Mechanism: client.GetConfig().name, Kind: ErrAuthenticationFailed, Message: "the server rejected the authentication", Err: err}
+		default:
+			return newError(client.GetConfig().name, ErrProtocol, "unknown status %d received from the transport", status)
+		}
+	}
+}
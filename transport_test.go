@@ -0,0 +1,91 @@
+package gosasl
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type serverMessage struct {
+	status    Status
+	challenge []byte
+}
+
+// scriptedTransport replays the server messages and records the responses
+type scriptedTransport struct {
+	messages  []serverMessage
+	responses [][]byte
+	onSend    func()
+	// reason is returned along with StatusFailed
+	reason error
+}
+
+func (t *scriptedTransport) Send(ctx context.Context, response []byte) error {
+	t.responses = append(t.responses, response)
+	if t.onSend != nil {
+		t.onSend()
+	}
+	return nil
+}
+
+func (t *scriptedTransport) Receive(ctx context.Context) (Status, []byte, error) {
+	message := t.messages[0]
+	t.messages = t.messages[1:]
+	if message.status == StatusFailed {
+		return message.status, message.challenge, t.reason
+	}
+	return message.status, message.challenge, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	client := NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	transport := &scriptedTransport{messages: []serverMessage{
+		{StatusContinue, []byte("msg")},
+		{StatusComplete, nil},
+	}}
+	if err := client.Authenticate(context.Background(), transport); err != nil {
+		t.Fatal(err)
+	}
+	var expected = []byte("user b6f058f088b733c17d01a621a9c19dc0")
+	if len(transport.responses) != 2 || transport.responses[0] != nil || !reflect.DeepEqual(transport.responses[1], expected) {
+		t.Fatalf("Unexpected responses %v", transport.responses)
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	client := NewSaslClient("localhost", NewPlainMechanism("user", "pass"))
+	transport := &scriptedTransport{messages: []serverMessage{{StatusFailed, nil}}}
+	if err := client.Authenticate(context.Background(), transport); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Expected ErrAuthenticationFailed, got %v", err)
+	}
+
+	// The reason given by the server is passed through
+	reason := errors.New("[UNAVAILABLE] try again later")
+	client = NewSaslClient("localhost", NewPlainMechanism("user", "pass"))
+	transport = &scriptedTransport{messages: []serverMessage{{StatusFailed, nil}}, reason: reason}
+	if err := client.Authenticate(context.Background(), transport); !errors.Is(err, ErrAuthenticationFailed) || !errors.Is(err, reason) {
+		t.Fatalf("Expected the reason of the server, got %v", err)
+	}
+
+	client = NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	transport = &scriptedTransport{messages: []serverMessage{{StatusComplete, nil}}}
+	if err := client.Authenticate(context.Background(), transport); err == nil {
+		t.Fatal("Completing before the mechanism should fail")
+	}
+}
+
+func TestAuthenticateCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewSaslClient("localhost", NewCramMD5Mechanism("user", "pass"))
+	transport := &scriptedTransport{
+		messages: []serverMessage{{StatusContinue, []byte("msg")}, {StatusComplete, nil}},
+		onSend:   cancel,
+	}
+	if err := client.Authenticate(ctx, transport); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if len(transport.responses) != 1 {
+		t.Fatalf("No step should run after the context is cancelled, got %d responses", len(transport.responses))
+	}
+}